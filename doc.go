@@ -57,6 +57,13 @@ Errors
 
 Errors returned by this package are of the form btcscript.StackErrX where X
 indicates the specific error.  See Variables in the package documentation for a
-full list.
+full list.  Script execution errors are returned as a *btcscript.ScriptError,
+which also has an ErrorCode, btcscript.ErrCodeX for btcscript.StackErrX, and
+says which opcode failed and where, and wraps the StackErrX error so that
+errors.Is can be used to check for it:
+
+	if errors.Is(err, btcscript.StackErrScriptFailed) {
+		...
+	}
 */
 package btcscript
@@ -0,0 +1,257 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcscript
+
+import (
+	"fmt"
+)
+
+// ErrorCode identifies a kind of script failure.  Each of the StackErr errors
+// has its own code, and codes are only ever added at the end so that their
+// values are stable.
+type ErrorCode int
+
+// These constants are the error codes of script failures, named ErrCode
+// followed by the name of the StackErr error they stand for, which keeps them
+// apart from the Err sentinel errors.
+const (
+	// ErrCodeUnknown is the code of failures that are not one of the
+	// StackErr errors, such as a malformed public key.
+	ErrCodeUnknown ErrorCode = iota
+	ErrCodeShortScript
+	ErrCodeUnderflow
+	ErrCodeInvalidArgs
+	ErrCodeOpDisabled
+	ErrCodeVerifyFailed
+	ErrCodeNumberTooBig
+	ErrCodeInvalidOpcode
+	ErrCodeReservedOpcode
+	ErrCodeEarlyReturn
+	ErrCodeNoIf
+	ErrCodeMissingEndif
+	ErrCodeTooManyPubkeys
+	ErrCodeTooManyOperations
+	ErrCodeElementTooBig
+	ErrCodeUnknownAddress
+	ErrCodeScriptFailed
+	ErrCodeScriptUnfinished
+	ErrCodeEmptyStack
+	ErrCodeP2SHNonPushOnly
+	ErrCodeInvalidParseType
+	ErrCodeInvalidAddrOffset
+	ErrCodeInvalidIndex
+	ErrCodeNonPushOnly
+	ErrCodeNegativeLockTime
+	ErrCodeUnsatisfiedLockTime
+	ErrCodeStackOverflow
+	ErrCodeScriptTooBig
+	ErrCodeMinimalData
+	ErrCodeMinimalPush
+	ErrCodeNullDummy
+	ErrCodeCleanStack
+	ErrCodeNullFail
+	ErrCodeMinimalIf
+	ErrCodeDiscourageUpgradableNops
+	ErrCodeWitnessMalleated
+	ErrCodeWitnessMalleatedP2SH
+	ErrCodeWitnessUnexpected
+	ErrCodeWitnessProgramEmpty
+	ErrCodeWitnessProgramMismatch
+	ErrCodeWitnessProgramWrongLength
+	ErrCodeInvalidPrevOuts
+	ErrCodeSchnorrSigSize
+	ErrCodeSchnorrSigHashType
+	ErrCodeSchnorrSig
+	ErrCodeHighS
+	ErrCodeInvalidSigHashType
+	ErrCodePubKeyType
+	ErrCodeTaprootControlBlock
+	ErrCodeTaprootMaxSigOps
+	ErrCodeTapscriptCheckMultiSig
+)
+
+// errorCodeStrings are the names of the error codes.
+var errorCodeStrings = map[ErrorCode]string{
+	ErrCodeUnknown:                   "ErrCodeUnknown",
+	ErrCodeShortScript:               "ErrCodeShortScript",
+	ErrCodeUnderflow:                 "ErrCodeUnderflow",
+	ErrCodeInvalidArgs:               "ErrCodeInvalidArgs",
+	ErrCodeOpDisabled:                "ErrCodeOpDisabled",
+	ErrCodeVerifyFailed:              "ErrCodeVerifyFailed",
+	ErrCodeNumberTooBig:              "ErrCodeNumberTooBig",
+	ErrCodeInvalidOpcode:             "ErrCodeInvalidOpcode",
+	ErrCodeReservedOpcode:            "ErrCodeReservedOpcode",
+	ErrCodeEarlyReturn:               "ErrCodeEarlyReturn",
+	ErrCodeNoIf:                      "ErrCodeNoIf",
+	ErrCodeMissingEndif:              "ErrCodeMissingEndif",
+	ErrCodeTooManyPubkeys:            "ErrCodeTooManyPubkeys",
+	ErrCodeTooManyOperations:         "ErrCodeTooManyOperations",
+	ErrCodeElementTooBig:             "ErrCodeElementTooBig",
+	ErrCodeUnknownAddress:            "ErrCodeUnknownAddress",
+	ErrCodeScriptFailed:              "ErrCodeScriptFailed",
+	ErrCodeScriptUnfinished:          "ErrCodeScriptUnfinished",
+	ErrCodeEmptyStack:                "ErrCodeEmptyStack",
+	ErrCodeP2SHNonPushOnly:           "ErrCodeP2SHNonPushOnly",
+	ErrCodeInvalidParseType:          "ErrCodeInvalidParseType",
+	ErrCodeInvalidAddrOffset:         "ErrCodeInvalidAddrOffset",
+	ErrCodeInvalidIndex:              "ErrCodeInvalidIndex",
+	ErrCodeNonPushOnly:               "ErrCodeNonPushOnly",
+	ErrCodeNegativeLockTime:          "ErrCodeNegativeLockTime",
+	ErrCodeUnsatisfiedLockTime:       "ErrCodeUnsatisfiedLockTime",
+	ErrCodeStackOverflow:             "ErrCodeStackOverflow",
+	ErrCodeScriptTooBig:              "ErrCodeScriptTooBig",
+	ErrCodeMinimalData:               "ErrCodeMinimalData",
+	ErrCodeMinimalPush:               "ErrCodeMinimalPush",
+	ErrCodeNullDummy:                 "ErrCodeNullDummy",
+	ErrCodeCleanStack:                "ErrCodeCleanStack",
+	ErrCodeNullFail:                  "ErrCodeNullFail",
+	ErrCodeMinimalIf:                 "ErrCodeMinimalIf",
+	ErrCodeDiscourageUpgradableNops:  "ErrCodeDiscourageUpgradableNops",
+	ErrCodeWitnessMalleated:          "ErrCodeWitnessMalleated",
+	ErrCodeWitnessMalleatedP2SH:      "ErrCodeWitnessMalleatedP2SH",
+	ErrCodeWitnessUnexpected:         "ErrCodeWitnessUnexpected",
+	ErrCodeWitnessProgramEmpty:       "ErrCodeWitnessProgramEmpty",
+	ErrCodeWitnessProgramMismatch:    "ErrCodeWitnessProgramMismatch",
+	ErrCodeWitnessProgramWrongLength: "ErrCodeWitnessProgramWrongLength",
+	ErrCodeInvalidPrevOuts:           "ErrCodeInvalidPrevOuts",
+	ErrCodeSchnorrSigSize:            "ErrCodeSchnorrSigSize",
+	ErrCodeSchnorrSigHashType:        "ErrCodeSchnorrSigHashType",
+	ErrCodeSchnorrSig:                "ErrCodeSchnorrSig",
+	ErrCodeHighS:                     "ErrCodeHighS",
+	ErrCodeInvalidSigHashType:        "ErrCodeInvalidSigHashType",
+	ErrCodePubKeyType:                "ErrCodePubKeyType",
+	ErrCodeTaprootControlBlock:       "ErrCodeTaprootControlBlock",
+	ErrCodeTaprootMaxSigOps:          "ErrCodeTaprootMaxSigOps",
+	ErrCodeTapscriptCheckMultiSig:    "ErrCodeTapscriptCheckMultiSig",
+}
+
+// String returns the name of the error code.
+func (e ErrorCode) String() string {
+	if s, ok := errorCodeStrings[e]; ok {
+		return s
+	}
+	return fmt.Sprintf("Unknown ErrorCode (%d)", int(e))
+}
+
+// errorCodes maps the StackErr errors to their codes.
+var errorCodes = map[error]ErrorCode{
+	StackErrShortScript:               ErrCodeShortScript,
+	StackErrUnderflow:                 ErrCodeUnderflow,
+	StackErrInvalidArgs:               ErrCodeInvalidArgs,
+	StackErrOpDisabled:                ErrCodeOpDisabled,
+	StackErrVerifyFailed:              ErrCodeVerifyFailed,
+	StackErrNumberTooBig:              ErrCodeNumberTooBig,
+	StackErrInvalidOpcode:             ErrCodeInvalidOpcode,
+	StackErrReservedOpcode:            ErrCodeReservedOpcode,
+	StackErrEarlyReturn:               ErrCodeEarlyReturn,
+	StackErrNoIf:                      ErrCodeNoIf,
+	StackErrMissingEndif:              ErrCodeMissingEndif,
+	StackErrTooManyPubkeys:            ErrCodeTooManyPubkeys,
+	StackErrTooManyOperations:         ErrCodeTooManyOperations,
+	StackErrElementTooBig:             ErrCodeElementTooBig,
+	StackErrUnknownAddress:            ErrCodeUnknownAddress,
+	StackErrScriptFailed:              ErrCodeScriptFailed,
+	StackErrScriptUnfinished:          ErrCodeScriptUnfinished,
+	StackErrEmptyStack:                ErrCodeEmptyStack,
+	StackErrP2SHNonPushOnly:           ErrCodeP2SHNonPushOnly,
+	StackErrInvalidParseType:          ErrCodeInvalidParseType,
+	StackErrInvalidAddrOffset:         ErrCodeInvalidAddrOffset,
+	StackErrInvalidIndex:              ErrCodeInvalidIndex,
+	StackErrNonPushOnly:               ErrCodeNonPushOnly,
+	StackErrNegativeLockTime:          ErrCodeNegativeLockTime,
+	StackErrUnsatisfiedLockTime:       ErrCodeUnsatisfiedLockTime,
+	StackErrStackOverflow:             ErrCodeStackOverflow,
+	StackErrScriptTooBig:              ErrCodeScriptTooBig,
+	StackErrMinimalData:               ErrCodeMinimalData,
+	StackErrMinimalPush:               ErrCodeMinimalPush,
+	StackErrNullDummy:                 ErrCodeNullDummy,
+	StackErrCleanStack:                ErrCodeCleanStack,
+	StackErrNullFail:                  ErrCodeNullFail,
+	StackErrMinimalIf:                 ErrCodeMinimalIf,
+	StackErrDiscourageUpgradableNops:  ErrCodeDiscourageUpgradableNops,
+	StackErrWitnessMalleated:          ErrCodeWitnessMalleated,
+	StackErrWitnessMalleatedP2SH:      ErrCodeWitnessMalleatedP2SH,
+	StackErrWitnessUnexpected:         ErrCodeWitnessUnexpected,
+	StackErrWitnessProgramEmpty:       ErrCodeWitnessProgramEmpty,
+	StackErrWitnessProgramMismatch:    ErrCodeWitnessProgramMismatch,
+	StackErrWitnessProgramWrongLength: ErrCodeWitnessProgramWrongLength,
+	StackErrInvalidPrevOuts:           ErrCodeInvalidPrevOuts,
+	StackErrSchnorrSigSize:            ErrCodeSchnorrSigSize,
+	StackErrSchnorrSigHashType:        ErrCodeSchnorrSigHashType,
+	StackErrSchnorrSig:                ErrCodeSchnorrSig,
+	StackErrHighS:                     ErrCodeHighS,
+	StackErrInvalidSigHashType:        ErrCodeInvalidSigHashType,
+	StackErrPubKeyType:                ErrCodePubKeyType,
+	StackErrTaprootControlBlock:       ErrCodeTaprootControlBlock,
+	StackErrTaprootMaxSigOps:          ErrCodeTaprootMaxSigOps,
+	StackErrTapscriptCheckMultiSig:    ErrCodeTapscriptCheckMultiSig,
+}
+
+// ScriptError is the error returned when a script fails to execute.  It says
+// what failed and where, and wraps the underlying error, which is one of the
+// StackErr errors unless ErrorCode is ErrCodeUnknown, so that errors.Is matches
+// it against them.
+type ScriptError struct {
+	// ErrorCode is the kind of failure.
+	ErrorCode ErrorCode
+
+	// Opcode is the name of the opcode that failed, or empty if the
+	// failure came after a script had ended, such as when it leaves
+	// false on the stack.
+	Opcode string
+
+	// ScriptIndex is the index of the script that failed: 0 for the
+	// signature script, 1 for the pkScript and 2 and on for redeem and
+	// witness scripts.
+	ScriptIndex int
+
+	// Offset is the index of the failed opcode in the script, or the
+	// number of opcodes in it if the failure came after it had ended.
+	Offset int
+
+	// Description is a description of the failure.
+	Description string
+
+	// Err is the underlying error.
+	Err error
+}
+
+// Error returns a description of the failure including where it happened.
+func (e *ScriptError) Error() string {
+	if e.Opcode == "" {
+		return fmt.Sprintf("%s at end of script %d", e.Description,
+			e.ScriptIndex)
+	}
+	return fmt.Sprintf("%s at script %d offset %d (%s)", e.Description,
+		e.ScriptIndex, e.Offset, e.Opcode)
+}
+
+// Unwrap returns the underlying error.
+func (e *ScriptError) Unwrap() error {
+	return e.Err
+}
+
+// newScriptError returns err as a *ScriptError that happened at offset in the
+// script at scriptIdx, naming the opcode there if there is one.
+func (m *Script) newScriptError(err error, scriptIdx, offset int) error {
+	if _, ok := err.(*ScriptError); ok {
+		return err
+	}
+	code, ok := errorCodes[err]
+	if !ok {
+		code = ErrCodeUnknown
+	}
+	scriptErr := &ScriptError{
+		ErrorCode:   code,
+		ScriptIndex: scriptIdx,
+		Offset:      offset,
+		Description: err.Error(),
+		Err:         err,
+	}
+	if scriptIdx < len(m.scripts) && offset < len(m.scripts[scriptIdx]) {
+		scriptErr.Opcode = m.scripts[scriptIdx][offset].opcode.name
+	}
+	return scriptErr
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcscript_test
+
+import (
+	"errors"
+	"github.com/conformal/btcscript"
+	"testing"
+)
+
+func TestErrorCodeStringer(t *testing.T) {
+	tests := []struct {
+		in   btcscript.ErrorCode
+		want string
+	}{
+		{btcscript.ErrCodeUnknown, "ErrCodeUnknown"},
+		{btcscript.ErrCodeUnderflow, "ErrCodeUnderflow"},
+		{btcscript.ErrCodeTapscriptCheckMultiSig,
+			"ErrCodeTapscriptCheckMultiSig"},
+		{0xffff, "Unknown ErrorCode (65535)"},
+	}
+
+	for _, test := range tests {
+		if got := test.in.String(); got != test.want {
+			t.Errorf("got %q, want %q", got, test.want)
+		}
+	}
+}
+
+func TestScriptError(t *testing.T) {
+	tests := []struct {
+		name        string
+		sigScript   []byte
+		pkScript    []byte
+		code        btcscript.ErrorCode
+		err         error
+		opcode      string
+		scriptIndex int
+		offset      int
+	}{
+		{
+			name:      "opcode failure",
+			sigScript: []byte{btcscript.OP_1},
+			pkScript: []byte{btcscript.OP_1, btcscript.OP_DROP,
+				btcscript.OP_DROP, btcscript.OP_DROP},
+			code:        btcscript.ErrCodeUnderflow,
+			err:         btcscript.StackErrUnderflow,
+			opcode:      "OP_DROP",
+			scriptIndex: 1,
+			offset:      3,
+		},
+		{
+			name:        "failure after the end",
+			sigScript:   []byte{btcscript.OP_1},
+			pkScript:    []byte{btcscript.OP_0},
+			code:        btcscript.ErrCodeScriptFailed,
+			err:         btcscript.StackErrScriptFailed,
+			scriptIndex: 1,
+			offset:      1,
+		},
+		{
+			name:      "signature script failure",
+			sigScript: []byte{btcscript.OP_1, btcscript.OP_RETURN},
+			pkScript:  []byte{btcscript.OP_1},
+			code:      btcscript.ErrCodeEarlyReturn,
+			err:       btcscript.StackErrEarlyReturn,
+			opcode:    "OP_RETURN",
+			offset:    1,
+		},
+		{
+			// The public key does not parse.
+			name: "unknown failure",
+			sigScript: []byte{btcscript.OP_DATA_2, 0x01, 0x01,
+				btcscript.OP_DATA_1, 0x05},
+			pkScript:    []byte{btcscript.OP_CHECKSIG},
+			code:        btcscript.ErrCodeUnknown,
+			opcode:      "OP_CHECKSIG",
+			scriptIndex: 1,
+		},
+	}
+
+	tx := witnessTx()
+	for _, test := range tests {
+		engine, err := btcscript.NewScript(test.sigScript,
+			test.pkScript, 0, tx, btcscript.ScriptBip16)
+		if err != nil {
+			t.Errorf("%s: failed to create script: %v", test.name,
+				err)
+			continue
+		}
+		err = engine.Execute()
+		var scriptErr *btcscript.ScriptError
+		if !errors.As(err, &scriptErr) {
+			t.Errorf("%s: got error [%v], want a ScriptError",
+				test.name, err)
+			continue
+		}
+		if test.err != nil && !errors.Is(err, test.err) {
+			t.Errorf("%s: error [%v] is not [%v]", test.name, err,
+				test.err)
+		}
+		if scriptErr.ErrorCode != test.code ||
+			scriptErr.Opcode != test.opcode ||
+			scriptErr.ScriptIndex != test.scriptIndex ||
+			scriptErr.Offset != test.offset {
+			t.Errorf("%s: got %v %q at %d:%d, want %v %q at %d:%d",
+				test.name, scriptErr.ErrorCode,
+				scriptErr.Opcode, scriptErr.ScriptIndex,
+				scriptErr.Offset, test.code, test.opcode,
+				test.scriptIndex, test.offset)
+		}
+	}
+}
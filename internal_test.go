@@ -49,6 +49,30 @@ func TstSignatureScriptCustomReader(reader io.Reader, tx *btcwire.MsgTx, idx int
 		hashType, privkey, compress)
 }
 
+// TstMakeScriptNum allows the test modules to test the internal function
+// makeScriptNum.
+func TstMakeScriptNum(v []byte, requireMinimal bool, scriptNumLen int) (ScriptNum, error) {
+	return makeScriptNum(v, requireMinimal, scriptNumLen)
+}
+
+// TstScriptIdx returns the index of the script being run.
+func (s *Script) TstScriptIdx() int {
+	return s.scriptidx
+}
+
+// TstIsWitnessVersionActive allows the test modules to test the internal
+// function isWitnessVersionActive.
+func (s *Script) TstIsWitnessVersionActive(version int) bool {
+	return s.isWitnessVersionActive(version)
+}
+
+// TstVerifySchnorr allows the test modules to test the internal function
+// verifySchnorr.
+
+func TstVerifySchnorr(pubKey, msg, sig []byte) bool {
+	return verifySchnorr(pubKey, msg, sig)
+}
+
 // Internal tests for opcodde parsing with bad data templates.
 func TestParseOpcode(t *testing.T) {
 	fakemap := make(map[byte]*opcode)
@@ -215,7 +215,9 @@ const (
 	OP_CHECKMULTISIGVERIFY      = 175
 	OP_NOP1                     = 176
 	OP_NOP2                     = 177
+	OP_CHECKLOCKTIMEVERIFY      = 177 // AKA OP_NOP2
 	OP_NOP3                     = 178
+	OP_CHECKSEQUENCEVERIFY      = 178 // AKA OP_NOP3
 	OP_NOP4                     = 179
 	OP_NOP5                     = 180
 	OP_NOP6                     = 181
@@ -224,6 +226,7 @@ const (
 	OP_NOP9                     = 184
 	OP_NOP10                    = 185
 	OP_UNKNOWN186               = 186
+	OP_CHECKSIGADD              = 186 // AKA OP_UNKNOWN186
 	OP_UNKNOWN187               = 187
 	OP_UNKNOWN188               = 188
 	OP_UNKNOWN189               = 189
@@ -671,10 +674,10 @@ var opcodemapPreinit = map[byte]*opcode{
 		opfunc: opcodeCheckMultiSigVerify},
 	OP_NOP1: {value: OP_NOP1, name: "OP_NOP1", length: 1,
 		opfunc: opcodeNop},
-	OP_NOP2: {value: OP_NOP2, name: "OP_NOP2", length: 1,
-		opfunc: opcodeNop},
-	OP_NOP3: {value: OP_NOP3, name: "OP_NOP3", length: 1,
-		opfunc: opcodeNop},
+	OP_NOP2: {value: OP_NOP2, name: "OP_CHECKLOCKTIMEVERIFY", length: 1,
+		opfunc: opcodeCheckLockTimeVerify},
+	OP_NOP3: {value: OP_NOP3, name: "OP_CHECKSEQUENCEVERIFY", length: 1,
+		opfunc: opcodeCheckSequenceVerify},
 	OP_NOP4: {value: OP_NOP4, name: "OP_NOP4", length: 1,
 		opfunc: opcodeNop},
 	OP_NOP5: {value: OP_NOP5, name: "OP_NOP5", length: 1,
@@ -689,8 +692,8 @@ var opcodemapPreinit = map[byte]*opcode{
 		opfunc: opcodeNop},
 	OP_NOP10: {value: OP_NOP10, name: "OP_NOP10", length: 1,
 		opfunc: opcodeNop},
-	OP_UNKNOWN186: {value: OP_UNKNOWN186, name: "OP_UNKNOWN186", length: 1,
-		opfunc: opcodeInvalid},
+	OP_UNKNOWN186: {value: OP_UNKNOWN186, name: "OP_CHECKSIGADD", length: 1,
+		opfunc: opcodeCheckSigAdd},
 	OP_UNKNOWN187: {value: OP_UNKNOWN187, name: "OP_UNKNOWN187", length: 1,
 		opfunc: opcodeInvalid},
 	OP_UNKNOWN188: {value: OP_UNKNOWN188, name: "OP_UNKNOWN188", length: 1,
@@ -862,12 +865,19 @@ type parsedOpcode struct {
 	opfunc func(op parsedOpcode, s Script) error
 }
 
+// conditional returns whether the opcode is run even when it is on the
+// non-executing side of a conditional.  OP_VERIF and OP_VERNOTIF are included
+// since bitcoind fails them there too.
 func (pop *parsedOpcode) conditional() bool {
 	switch pop.opcode.value {
 	case OP_IF:
 		return true
 	case OP_NOTIF:
 		return true
+	case OP_VERIF:
+		return true
+	case OP_VERNOTIF:
+		return true
 	case OP_ELSE:
 		return true
 	case OP_ENDIF:
@@ -877,18 +887,46 @@ func (pop *parsedOpcode) conditional() bool {
 	}
 }
 
-func (pop *parsedOpcode) exec(s *Script) error {
-	// *sigh* bitcoind pretty much mandates that we violate layering here.
-	// Any opcode that isn't just adding data to the stack counts here
-	// as an operation. Note that OP_RESERVED is less than OP_16 and thus
-	// is counted as a push opcode here.
-	if pop.opcode.value > OP_16 {
-		s.numOps++
-		if s.numOps > MaxOpsPerScript {
-			return StackErrTooManyOperations
-		}
-
+// disabled returns whether the opcode is disabled and thus fails the script
+// wherever it appears.
+func (pop *parsedOpcode) disabled() bool {
+	switch pop.opcode.value {
+	case OP_CAT:
+		return true
+	case OP_SUBSTR:
+		return true
+	case OP_LEFT:
+		return true
+	case OP_RIGHT:
+		return true
+	case OP_INVERT:
+		return true
+	case OP_AND:
+		return true
+	case OP_OR:
+		return true
+	case OP_XOR:
+		return true
+	case OP_2MUL:
+		return true
+	case OP_2DIV:
+		return true
+	case OP_MUL:
+		return true
+	case OP_DIV:
+		return true
+	case OP_MOD:
+		return true
+	case OP_LSHIFT:
+		return true
+	case OP_RSHIFT:
+		return true
+	default:
+		return false
 	}
+}
+
+func (pop *parsedOpcode) exec(s *Script) error {
 	return pop.opcode.opfunc(pop, s)
 }
 
@@ -994,32 +1032,200 @@ func opcodeFalse(op *parsedOpcode, s *Script) error {
 	return nil
 }
 
+// checkMinimalDataPush returns StackErrMinimalPush if the data of op could
+// have been pushed with a smaller opcode.
+func checkMinimalDataPush(op *parsedOpcode) error {
+	data := op.data
+	dataLen := len(data)
+	opcode := op.opcode.value
+
+	if dataLen == 0 && opcode != OP_0 {
+		return StackErrMinimalPush
+	} else if dataLen == 1 && data[0] >= 1 && data[0] <= 16 {
+		if opcode != OP_1+data[0]-1 {
+			return StackErrMinimalPush
+		}
+	} else if dataLen == 1 && data[0] == 0x81 {
+		if opcode != OP_1NEGATE {
+			return StackErrMinimalPush
+		}
+	} else if dataLen <= 75 {
+		if int(opcode) != dataLen {
+			return StackErrMinimalPush
+		}
+	} else if dataLen <= 255 {
+		if opcode != OP_PUSHDATA1 {
+			return StackErrMinimalPush
+		}
+	} else if dataLen <= 65535 {
+		if opcode != OP_PUSHDATA2 {
+			return StackErrMinimalPush
+		}
+	}
+	return nil
+}
+
 func opcodePushData(op *parsedOpcode, s *Script) error {
-	// This max script element test must occur at execution time instead
-	// of parse time to match bitcoind behaviour.
-	if len(op.data) > MaxScriptElementSize {
-		return StackErrElementTooBig
+	if s.hasFlag(ScriptVerifyMinimalData) {
+		if err := checkMinimalDataPush(op); err != nil {
+			return err
+		}
 	}
 	s.dstack.PushByteArray(op.data)
 	return nil
 }
 
 func opcode1Negate(op *parsedOpcode, s *Script) error {
-	s.dstack.PushInt(big.NewInt(-1))
+	s.dstack.PushInt(ScriptNum(-1))
 	return nil
 }
 
 func opcodeN(op *parsedOpcode, s *Script) error {
 	// 16 consecutive opcodes add increasing numbers to the stack.
-	s.dstack.PushInt(big.NewInt(int64(op.opcode.value - (OP_1 - 1))))
+	s.dstack.PushInt(ScriptNum(op.opcode.value - (OP_1 - 1)))
 	return nil
 }
 
 func opcodeNop(op *parsedOpcode, s *Script) error {
+	if op.opcode.value != OP_NOP {
+		return s.discourageUpgradableNop()
+	}
 	// This page left intentionally blank
 	return nil
 }
 
+// discourageUpgradableNop returns StackErrDiscourageUpgradableNops if an
+// upgradable NOP opcode, which may be given a meaning by a future soft fork,
+// should not be executed.
+func (s *Script) discourageUpgradableNop() error {
+	if s.hasFlag(ScriptDiscourageUpgradableNops) {
+		return StackErrDiscourageUpgradableNops
+	}
+	return nil
+}
+
+// verifyLockTime checks that lockTime, taken from a script, is satisfied by
+// txLockTime.  Both must be on the same side of threshold, that is both block
+// heights or both timestamps, and lockTime must not be past txLockTime.
+func verifyLockTime(txLockTime, threshold, lockTime int64) error {
+	if !((txLockTime < threshold && lockTime < threshold) ||
+		(txLockTime >= threshold && lockTime >= threshold)) {
+		return StackErrUnsatisfiedLockTime
+	}
+
+	if lockTime > txLockTime {
+		return StackErrUnsatisfiedLockTime
+	}
+	return nil
+}
+
+// opcodeCheckLockTimeVerify compares the item on top of the stack, without
+// removing it, against the lock time of the transaction and fails unless the
+// transaction can not be mined before that time.  Unless the engine has the
+// ScriptVerifyCheckLockTimeVerify flag set it behaves as OP_NOP2.
+func opcodeCheckLockTimeVerify(op *parsedOpcode, s *Script) error {
+	if !s.hasFlag(ScriptVerifyCheckLockTimeVerify) {
+		return s.discourageUpgradableNop()
+	}
+
+	so, err := s.dstack.PeekByteArray(0)
+	if err != nil {
+		return err
+	}
+
+	// Lock times are unsigned 32-bit values, so a 5 byte number is
+	// allowed here rather than the usual 4 bytes in order to reach past
+	// 2^31-1.
+	lockTime, err := makeScriptNum(so, s.dstack.verifyMinimalData, 5)
+	if err != nil {
+		return err
+	}
+	if lockTime < 0 {
+		return StackErrNegativeLockTime
+	}
+
+	err = verifyLockTime(int64(s.tx.LockTime), LockTimeThreshold,
+		int64(lockTime))
+	if err != nil {
+		return err
+	}
+
+	// A final input disables lock time checking for the whole
+	// transaction, which would render the opcode meaningless.  Requiring
+	// the input being validated to be non-final is enough to prevent that.
+	if s.tx.TxIn[s.txidx].Sequence == btcwire.MaxTxInSequenceNum {
+		return StackErrUnsatisfiedLockTime
+	}
+	return nil
+}
+
+// opcodeCheckSequenceVerify compares the item on top of the stack, without
+// removing it, against the sequence number of the input being validated and
+// fails unless the relative lock time (bip68) it encodes is at least the one
+// required by the script.  Unless the engine has the
+// ScriptVerifyCheckSequenceVerify flag set it behaves as OP_NOP3.
+func opcodeCheckSequenceVerify(op *parsedOpcode, s *Script) error {
+	if !s.hasFlag(ScriptVerifyCheckSequenceVerify) {
+		return s.discourageUpgradableNop()
+	}
+
+	so, err := s.dstack.PeekByteArray(0)
+	if err != nil {
+		return err
+	}
+
+	// Sequence numbers are unsigned 32-bit values, so a 5 byte number is
+	// allowed here for the same reason as in OP_CHECKLOCKTIMEVERIFY.
+	stackSequence, err := makeScriptNum(so, s.dstack.verifyMinimalData, 5)
+	if err != nil {
+		return err
+	}
+	if stackSequence < 0 {
+		return StackErrNegativeLockTime
+	}
+	sequence := int64(stackSequence)
+
+	// An operand with the disable bit set is left for future soft forks
+	// to give a meaning to, so treat the opcode as a no-op for now.
+	if sequence&SequenceLockTimeDisabled != 0 {
+		return nil
+	}
+
+	// Relative lock times are only enforced for transaction version 2
+	// and above and for inputs which do not have them disabled.
+	if s.tx.Version < 2 {
+		return StackErrUnsatisfiedLockTime
+	}
+	txSequence := int64(s.tx.TxIn[s.txidx].Sequence)
+	if txSequence&SequenceLockTimeDisabled != 0 {
+		return StackErrUnsatisfiedLockTime
+	}
+
+	// Only the type flag and the lock time value take part in the
+	// comparison.
+	lockTimeMask := int64(SequenceLockTimeIsSeconds | SequenceLockTimeMask)
+	return verifyLockTime(txSequence&lockTimeMask,
+		SequenceLockTimeIsSeconds, sequence&lockTimeMask)
+}
+
+// popIfBool pops the argument of OP_IF or OP_NOTIF.  When
+// ScriptVerifyMinimalIf is set, or in a tapscript, it must be empty or
+// exactly 0x01.
+func (s *Script) popIfBool() (bool, error) {
+	if !s.hasFlag(ScriptVerifyMinimalIf) && !s.isWitnessVersionActive(1) {
+		return s.dstack.PopBool()
+	}
+
+	so, err := s.dstack.PopByteArray()
+	if err != nil {
+		return false, err
+	}
+	if len(so) > 1 || (len(so) == 1 && so[0] != 0x01) {
+		return false, StackErrMinimalIf
+	}
+	return len(so) == 1, nil
+}
+
 // opcodeIf computes true/false based on the value on the stack and pushes
 // the condition on the condStack (conditional execution stack)
 func opcodeIf(op *parsedOpcode, s *Script) error {
@@ -1027,7 +1233,7 @@ func opcodeIf(op *parsedOpcode, s *Script) error {
 	// of the conditional, this is so proper nesting is maintained
 	var condval int
 	if s.condStack[0] == OpCondTrue {
-		ok, err := s.dstack.PopBool()
+		ok, err := s.popIfBool()
 		if err != nil {
 			return err
 		}
@@ -1051,7 +1257,7 @@ func opcodeNotIf(op *parsedOpcode, s *Script) error {
 	// of the conditional, this is so proper nesting is maintained
 	var condval int
 	if s.condStack[0] == OpCondTrue {
-		ok, err := s.dstack.PopBool()
+		ok, err := s.popIfBool()
 		if err != nil {
 			return err
 		}
@@ -1167,7 +1373,7 @@ func opcodeIfDup(op *parsedOpcode, s *Script) error {
 	}
 
 	// Push copy of data iff it isn't zero
-	if val.Sign() != 0 {
+	if val != 0 {
 		s.dstack.PushInt(val)
 	}
 
@@ -1175,7 +1381,7 @@ func opcodeIfDup(op *parsedOpcode, s *Script) error {
 }
 
 func opcodeDepth(op *parsedOpcode, s *Script) error {
-	s.dstack.PushInt(big.NewInt(int64(s.dstack.Depth())))
+	s.dstack.PushInt(ScriptNum(s.dstack.Depth()))
 	return nil
 }
 
@@ -1203,13 +1409,7 @@ func opcodePick(op *parsedOpcode, s *Script) error {
 		return err
 	}
 
-	if pidx.BitLen() > 32 {
-		return StackErrNumberTooBig
-	}
-
-	val := int(pidx.Int64())
-
-	return s.dstack.PickN(val)
+	return s.dstack.PickN(int(pidx.Int32()))
 }
 
 // Move object N items back in the stack to the top. Where N is the value in
@@ -1220,13 +1420,7 @@ func opcodeRoll(op *parsedOpcode, s *Script) error {
 		return err
 	}
 
-	if ridx.BitLen() > 32 {
-		return StackErrNumberTooBig
-	}
-
-	val := int(ridx.Int64())
-
-	return s.dstack.RollN(val)
+	return s.dstack.RollN(int(ridx.Int32()))
 }
 
 // Rotate top three items on the stack to the left.
@@ -1253,7 +1447,7 @@ func opcodeSize(op *parsedOpcode, s *Script) error {
 		return err
 	}
 
-	s.dstack.PushInt(big.NewInt(int64(len(i))))
+	s.dstack.PushInt(ScriptNum(len(i)))
 	return nil
 }
 
@@ -1285,7 +1479,7 @@ func opcode1Add(op *parsedOpcode, s *Script) error {
 		return err
 	}
 
-	s.dstack.PushInt(new(big.Int).Add(m, big.NewInt(1)))
+	s.dstack.PushInt(m + 1)
 
 	return nil
 }
@@ -1295,30 +1489,31 @@ func opcode1Sub(op *parsedOpcode, s *Script) error {
 	if err != nil {
 		return err
 	}
-	s.dstack.PushInt(new(big.Int).Sub(m, big.NewInt(1)))
+	s.dstack.PushInt(m - 1)
 
 	return nil
 }
 
 func opcodeNegate(op *parsedOpcode, s *Script) error {
-	// XXX when we remove types just flip the 0x80 bit of msb
 	m, err := s.dstack.PopInt()
 	if err != nil {
 		return err
 	}
 
-	s.dstack.PushInt(new(big.Int).Neg(m))
+	s.dstack.PushInt(-m)
 	return nil
 }
 
 func opcodeAbs(op *parsedOpcode, s *Script) error {
-	// XXX when we remove types just &= ~0x80 on msb
 	m, err := s.dstack.PopInt()
 	if err != nil {
 		return err
 	}
 
-	s.dstack.PushInt(new(big.Int).Abs(m))
+	if m < 0 {
+		m = -m
+	}
+	s.dstack.PushInt(m)
 
 	return nil
 }
@@ -1330,10 +1525,10 @@ func opcodeNot(op *parsedOpcode, s *Script) error {
 	if err != nil {
 		return err
 	}
-	if m.Sign() == 0 {
-		s.dstack.PushInt(big.NewInt(1))
+	if m == 0 {
+		s.dstack.PushInt(1)
 	} else {
-		s.dstack.PushInt(big.NewInt(0))
+		s.dstack.PushInt(0)
 	}
 	return nil
 }
@@ -1344,8 +1539,8 @@ func opcode0NotEqual(op *parsedOpcode, s *Script) error {
 	if err != nil {
 		return err
 	}
-	if m.Sign() != 0 {
-		m.SetInt64(1)
+	if m != 0 {
+		m = 1
 	}
 	s.dstack.PushInt(m)
 
@@ -1364,7 +1559,7 @@ func opcodeAdd(op *parsedOpcode, s *Script) error {
 		return err
 	}
 
-	s.dstack.PushInt(new(big.Int).Add(v0, v1))
+	s.dstack.PushInt(v0 + v1)
 	return nil
 }
 
@@ -1380,7 +1575,7 @@ func opcodeSub(op *parsedOpcode, s *Script) error {
 		return err
 	}
 
-	s.dstack.PushInt(new(big.Int).Sub(v1, v0))
+	s.dstack.PushInt(v1 - v0)
 	return nil
 }
 
@@ -1397,10 +1592,10 @@ func opcodeBoolAnd(op *parsedOpcode, s *Script) error {
 		return err
 	}
 
-	if v0.Sign() != 0 && v1.Sign() != 0 {
-		s.dstack.PushInt(big.NewInt(1))
+	if v0 != 0 && v1 != 0 {
+		s.dstack.PushInt(1)
 	} else {
-		s.dstack.PushInt(big.NewInt(0))
+		s.dstack.PushInt(0)
 	}
 
 	return nil
@@ -1419,10 +1614,10 @@ func opcodeBoolOr(op *parsedOpcode, s *Script) error {
 		return err
 	}
 
-	if v0.Sign() != 0 || v1.Sign() != 0 {
-		s.dstack.PushInt(big.NewInt(1))
+	if v0 != 0 || v1 != 0 {
+		s.dstack.PushInt(1)
 	} else {
-		s.dstack.PushInt(big.NewInt(0))
+		s.dstack.PushInt(0)
 	}
 
 	return nil
@@ -1439,10 +1634,10 @@ func opcodeNumEqual(op *parsedOpcode, s *Script) error {
 		return err
 	}
 
-	if v0.Cmp(v1) == 0 {
-		s.dstack.PushInt(big.NewInt(1))
+	if v0 == v1 {
+		s.dstack.PushInt(1)
 	} else {
-		s.dstack.PushInt(big.NewInt(0))
+		s.dstack.PushInt(0)
 	}
 
 	return nil
@@ -1467,10 +1662,10 @@ func opcodeNumNotEqual(op *parsedOpcode, s *Script) error {
 		return err
 	}
 
-	if v0.Cmp(v1) != 0 {
-		s.dstack.PushInt(big.NewInt(1))
+	if v0 != v1 {
+		s.dstack.PushInt(1)
 	} else {
-		s.dstack.PushInt(big.NewInt(0))
+		s.dstack.PushInt(0)
 	}
 
 	return nil
@@ -1487,10 +1682,10 @@ func opcodeLessThan(op *parsedOpcode, s *Script) error {
 		return err
 	}
 
-	if v1.Cmp(v0) == -1 {
-		s.dstack.PushInt(big.NewInt(1))
+	if v1 < v0 {
+		s.dstack.PushInt(1)
 	} else {
-		s.dstack.PushInt(big.NewInt(0))
+		s.dstack.PushInt(0)
 	}
 
 	return nil
@@ -1507,10 +1702,10 @@ func opcodeGreaterThan(op *parsedOpcode, s *Script) error {
 		return err
 	}
 
-	if v1.Cmp(v0) == 1 {
-		s.dstack.PushInt(big.NewInt(1))
+	if v1 > v0 {
+		s.dstack.PushInt(1)
 	} else {
-		s.dstack.PushInt(big.NewInt(0))
+		s.dstack.PushInt(0)
 	}
 	return nil
 }
@@ -1526,10 +1721,10 @@ func opcodeLessThanOrEqual(op *parsedOpcode, s *Script) error {
 		return err
 	}
 
-	if v1.Cmp(v0) <= 0 {
-		s.dstack.PushInt(big.NewInt(1))
+	if v1 <= v0 {
+		s.dstack.PushInt(1)
 	} else {
-		s.dstack.PushInt(big.NewInt(0))
+		s.dstack.PushInt(0)
 	}
 	return nil
 }
@@ -1545,10 +1740,10 @@ func opcodeGreaterThanOrEqual(op *parsedOpcode, s *Script) error {
 		return err
 	}
 
-	if v1.Cmp(v0) >= 0 {
-		s.dstack.PushInt(big.NewInt(1))
+	if v1 >= v0 {
+		s.dstack.PushInt(1)
 	} else {
-		s.dstack.PushInt(big.NewInt(0))
+		s.dstack.PushInt(0)
 	}
 
 	return nil
@@ -1565,10 +1760,10 @@ func opcodeMin(op *parsedOpcode, s *Script) error {
 		return err
 	}
 
-	if v1.Cmp(v0) == -1 {
-		s.dstack.PushInt(new(big.Int).Set(v1))
+	if v1 < v0 {
+		s.dstack.PushInt(v1)
 	} else {
-		s.dstack.PushInt(new(big.Int).Set(v0))
+		s.dstack.PushInt(v0)
 	}
 
 	return nil
@@ -1585,10 +1780,10 @@ func opcodeMax(op *parsedOpcode, s *Script) error {
 		return err
 	}
 
-	if v1.Cmp(v0) == 1 {
-		s.dstack.PushInt(new(big.Int).Set(v1))
+	if v1 > v0 {
+		s.dstack.PushInt(v1)
 	} else {
-		s.dstack.PushInt(new(big.Int).Set(v0))
+		s.dstack.PushInt(v0)
 	}
 
 	return nil
@@ -1612,10 +1807,10 @@ func opcodeWithin(op *parsedOpcode, s *Script) error {
 		return err
 	}
 
-	if x.Cmp(minVal) >= 0 && x.Cmp(maxVal) == -1 {
-		s.dstack.PushInt(big.NewInt(1))
+	if x >= minVal && x < maxVal {
+		s.dstack.PushInt(1)
 	} else {
-		s.dstack.PushInt(big.NewInt(0))
+		s.dstack.PushInt(0)
 	}
 	return nil
 }
@@ -1683,10 +1878,82 @@ func opcodeHash256(op *parsedOpcode, s *Script) error {
 
 func opcodeCodeSeparator(op *parsedOpcode, s *Script) error {
 	s.lastcodesep = s.scriptoff
+	if s.isWitnessVersionActive(1) {
+		s.tapCodeSepPos = uint32(s.scriptoff)
+	}
 
 	return nil
 }
 
+// halfOrder is half the order of the secp256k1 group.  Signatures with an S
+// value above it are rejected when ScriptVerifyLowS is set.
+var halfOrder = new(big.Int).Rsh(btcec.S256().N, 1)
+
+// parseSignature parses sigStr, without the hashtype byte, in the encoding
+// required by the script flags and checks its S value if low S signatures
+// are required.
+func (s *Script) parseSignature(sigStr []byte) (*btcec.Signature, error) {
+	var signature *btcec.Signature
+	var err error
+	if s.der {
+		signature, err = btcec.ParseDERSignature(sigStr, btcec.S256())
+	} else {
+		signature, err = btcec.ParseSignature(sigStr, btcec.S256())
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.hasFlag(ScriptVerifyLowS) && signature.S.Cmp(halfOrder) > 0 {
+		return nil, StackErrHighS
+	}
+	return signature, nil
+}
+
+// checkHashTypeEncoding returns StackErrInvalidSigHashType if strict encoding
+// is required and hashType is not one of the defined signature hash types.
+func (s *Script) checkHashTypeEncoding(hashType byte) error {
+	if !s.hasFlag(ScriptVerifyStrictEncoding) {
+		return nil
+	}
+
+	sigHashType := hashType &^ SigHashAnyOneCanPay
+	if sigHashType < SigHashAll || sigHashType > SigHashSingle {
+		return StackErrInvalidSigHashType
+	}
+	return nil
+}
+
+// checkPubKeyEncoding returns StackErrPubKeyType if strict encoding is
+// required and pubKey is neither a compressed nor an uncompressed key.
+func (s *Script) checkPubKeyEncoding(pubKey []byte) error {
+	if !s.hasFlag(ScriptVerifyStrictEncoding) {
+		return nil
+	}
+
+	if len(pubKey) == 33 && (pubKey[0] == 0x02 || pubKey[0] == 0x03) {
+		return nil
+	}
+	if len(pubKey) == 65 && pubKey[0] == 0x04 {
+		return nil
+	}
+	return StackErrPubKeyType
+}
+
+// verifySignature returns whether signature, parsed from sigStr, is a valid
+// signature of hash for pubKey, parsed from pkStr.  The signature cache of the
+// engine, if it has one, is checked first and valid signatures are added to
+// it.
+func (s *Script) verifySignature(hash, sigStr []byte, signature *btcec.Signature, pkStr []byte, pubKey *ecdsa.PublicKey) bool {
+	if s.sigCache != nil && s.sigCache.Exists(hash, sigStr, pkStr) {
+		return true
+	}
+	ok := ecdsa.Verify(pubKey, hash, signature.R, signature.S)
+	if ok && s.sigCache != nil {
+		s.sigCache.Add(hash, sigStr, pkStr)
+	}
+	return ok
+}
+
 func opcodeCheckSig(op *parsedOpcode, s *Script) error {
 
 	pkStr, err := s.dstack.PopByteArray()
@@ -1699,10 +1966,23 @@ func opcodeCheckSig(op *parsedOpcode, s *Script) error {
 		return err
 	}
 
+	if s.isWitnessVersionActive(1) {
+		ok, err := s.checkTapscriptSig(sigStr, pkStr)
+		if err != nil {
+			return err
+		}
+		s.dstack.PushBool(ok)
+		return nil
+	}
+
 	// Signature actually needs needs to be longer than this, but we need
 	// at least  1 byte for the below. btcec will check full length upon
-	// parsing the signature.
+	// parsing the signature.  The encoding of the public key is checked
+	// even though an empty signature can never match it.
 	if len(sigStr) < 1 {
+		if err := s.checkPubKeyEncoding(pkStr); err != nil {
+			return err
+		}
 		s.dstack.PushBool(false)
 		return nil
 	}
@@ -1711,27 +1991,27 @@ func opcodeCheckSig(op *parsedOpcode, s *Script) error {
 	hashType := sigStr[len(sigStr)-1]
 	sigStr = sigStr[:len(sigStr)-1]
 
+	if err := s.checkHashTypeEncoding(hashType); err != nil {
+		return err
+	}
+	if err := s.checkPubKeyEncoding(pkStr); err != nil {
+		return err
+	}
+
 	// Get script from the last OP_CODESEPARATOR and without any subsequent
 	// OP_CODESEPARATORs
 	subScript := s.subScript()
 
-	// Unlikely to hit any cases here, but remove the signature from
-	// the script if present.
-	subScript = removeOpcodeByData(subScript, sigStr)
-
-	hash := calcScriptHash(subScript, hashType, &s.tx, s.txidx)
+	// Unlikely to hit any cases here, but the signature is removed from
+	// the script if present, unless this is a witness script.
+	hash := s.calcSignatureHash(subScript, hashType, sigStr)
 
 	pubKey, err := btcec.ParsePubKey(pkStr, btcec.S256())
 	if err != nil {
 		return err
 	}
 
-	var signature *btcec.Signature
-	if s.der {
-		signature, err = btcec.ParseDERSignature(sigStr, btcec.S256())
-	} else {
-		signature, err = btcec.ParseSignature(sigStr, btcec.S256())
-	}
+	signature, err := s.parseSignature(sigStr)
 	if err != nil {
 		return err
 	}
@@ -1742,7 +2022,11 @@ func opcodeCheckSig(op *parsedOpcode, s *Script) error {
 			spew.Sdump(pkStr), pubKey.X, pubKey.Y,
 			signature.R, signature.S, spew.Sdump(hash))
 	}))
-	ok := ecdsa.Verify(pubKey, hash, signature.R, signature.S)
+	ok := s.verifySignature(hash, sigStr, signature, pkStr, pubKey)
+	if !ok && s.hasFlag(ScriptVerifyNullFail) {
+		// The empty signature case returned above.
+		return StackErrNullFail
+	}
 	s.dstack.PushBool(ok)
 	return nil
 }
@@ -1755,8 +2039,61 @@ func opcodeCheckSigVerify(op *parsedOpcode, s *Script) error {
 	return err
 }
 
+// opcodeCheckSigAdd is only defined in tapscript (bip342), where it pops a
+// public key, a number and a signature and pushes the number plus one if the
+// signature is valid, or the number unchanged if it is empty.  Elsewhere it
+// is an invalid opcode.
+func opcodeCheckSigAdd(op *parsedOpcode, s *Script) error {
+	if !s.isWitnessVersionActive(1) {
+		return StackErrInvalidOpcode
+	}
+
+	pkStr, err := s.dstack.PopByteArray()
+	if err != nil {
+		return err
+	}
+
+	n, err := s.dstack.PopInt()
+	if err != nil {
+		return err
+	}
+
+	sigStr, err := s.dstack.PopByteArray()
+	if err != nil {
+		return err
+	}
+
+	ok, err := s.checkTapscriptSig(sigStr, pkStr)
+	if err != nil {
+		return err
+	}
+	if ok {
+		n++
+	}
+	s.dstack.PushInt(n)
+	return nil
+}
+
+// failMultiSig pushes the false result of an OP_CHECKMULTISIG, unless
+// ScriptVerifyNullFail is set and one of sigStrings is not empty, in which
+// case StackErrNullFail is returned.
+func (s *Script) failMultiSig(sigStrings [][]byte) error {
+	if s.hasFlag(ScriptVerifyNullFail) {
+		for _, sig := range sigStrings {
+			if len(sig) != 0 {
+				return StackErrNullFail
+			}
+		}
+	}
+	s.dstack.PushBool(false)
+	return nil
+}
+
 // stack; sigs <numsigs> pubkeys <numpubkeys>
 func opcodeCheckMultiSig(op *parsedOpcode, s *Script) error {
+	if s.isWitnessVersionActive(1) {
+		return StackErrTapscriptCheckMultiSig
+	}
 
 	numPubkeys, err := s.dstack.PopInt()
 	if err != nil {
@@ -1766,11 +2103,7 @@ func opcodeCheckMultiSig(op *parsedOpcode, s *Script) error {
 	// XXX arbitrary limits
 	// nore more than 20 pubkeyhs, or 201 operations
 
-	if numPubkeys.BitLen() > 32 {
-		return StackErrNumberTooBig
-	}
-
-	npk := int(numPubkeys.Int64())
+	npk := int(numPubkeys.Int32())
 	if npk < 0 || npk > MaxPubKeysPerMultiSig {
 		return StackErrTooManyPubkeys
 	}
@@ -1779,8 +2112,7 @@ func opcodeCheckMultiSig(op *parsedOpcode, s *Script) error {
 		return StackErrTooManyOperations
 	}
 	pubKeyStrings := make([][]byte, npk)
-	pubKeys := make([]*ecdsa.PublicKey, npk)
-	for i := range pubKeys {
+	for i := range pubKeyStrings {
 		pubKeyStrings[i], err = s.dstack.PopByteArray()
 		if err != nil {
 			return err
@@ -1791,82 +2123,80 @@ func opcodeCheckMultiSig(op *parsedOpcode, s *Script) error {
 	if err != nil {
 		return err
 	}
-	if numSignatures.BitLen() > 32 {
-		return StackErrNumberTooBig
+	nsig := int(numSignatures.Int32())
+	if nsig < 0 || nsig > npk {
+		return StackErrInvalidArgs
 	}
 
-	nsig := int(numSignatures.Int64())
-
 	sigStrings := make([][]byte, nsig)
-	signatures := make([]*btcec.Signature, nsig)
-	for i := range signatures {
+	for i := range sigStrings {
 		sigStrings[i], err = s.dstack.PopByteArray()
 		if err != nil {
 			return err
 		}
-		// skip off the last byte for hashtype
-		if s.der {
-			signatures[i], err =
-				btcec.ParseDERSignature(
-					sigStrings[i][:len(sigStrings[i])-1],
-					btcec.S256())
-		} else {
-			signatures[i], err =
-				btcec.ParseSignature(
-					sigStrings[i][:len(sigStrings[i])-1],
-					btcec.S256())
-		}
-		if err != nil {
-			return err
-		}
 	}
 
 	// bug in bitcoind mean we pop one more stack value than should be used.
-	_, err = s.dstack.PopByteArray()
+	dummy, err := s.dstack.PopByteArray()
 	if err != nil {
-		return nil
+		return err
+	}
+	if s.hasFlag(ScriptVerifyNullDummy) && len(dummy) != 0 {
+		return StackErrNullDummy
 	}
 
 	// Trim OP_CODESEPARATORs
 	script := s.subScript()
 
-	// Remove any of the signatures that happen to be in the script.
-	// can't sign somthing containing the signature you're making, after
-	// all
-	for i := range sigStrings {
-		script = removeOpcodeByData(script, sigStrings[i])
-	}
-
-	curPk := 0
-	for i := range signatures {
-		// check signatures.
-		success := false
-		// get hashtype from original byte string
-		hashType := sigStrings[i][len(sigStrings[i])-1]
-
-		hash := calcScriptHash(script, hashType, &s.tx, s.txidx)
-	inner:
-		// Find first pubkey that successfully validates signature.
-		// we start off the search from the key that was successful
-		// last time.
-		for ; curPk < len(pubKeys); curPk++ {
-			if pubKeys[curPk] == nil {
-				pubKeys[curPk], err =
-					btcec.ParsePubKey(pubKeyStrings[curPk],
-						btcec.S256())
-				if err != nil {
-					continue
-				}
+	// Each signature is tried against the keys in order, starting after
+	// the key that matched the previous signature, and the check fails as
+	// soon as too few keys are left for the remaining signatures.  Like in
+	// bitcoind, only the signatures and keys that are tried have their
+	// encoding checked, empty signatures included.
+	var signature *btcec.Signature
+	var hash []byte
+	sigIdx := 0
+	for keyIdx := 0; sigIdx < nsig; keyIdx++ {
+		if nsig-sigIdx > npk-keyIdx {
+			return s.failMultiSig(sigStrings)
+		}
+		sigStr := sigStrings[sigIdx]
+		pkStr := pubKeyStrings[keyIdx]
+
+		if len(sigStr) != 0 && signature == nil {
+			// skip off the last byte for hashtype
+			hashType := sigStr[len(sigStr)-1]
+			if err := s.checkHashTypeEncoding(hashType); err != nil {
+				return err
 			}
-			success = ecdsa.Verify(pubKeys[curPk], hash,
-				signatures[i].R, signatures[i].S)
-			if success {
-				break inner
+			signature, err = s.parseSignature(sigStr[:len(sigStr)-1])
+			if err != nil {
+				return err
 			}
+
+			// Any of the signatures that happen to be in the script
+			// are removed, can't sign somthing containing the
+			// signature you're making, after all.  Witness scripts
+			// are signed as they are.
+			hash = s.calcSignatureHash(script, hashType,
+				sigStrings...)
+		}
+		if err := s.checkPubKeyEncoding(pkStr); err != nil {
+			return err
+		}
+		if signature == nil {
+			// An empty signature can never match.
+			continue
+		}
+
+		pubKey, err := btcec.ParsePubKey(pkStr, btcec.S256())
+		if err != nil {
+			continue
 		}
-		if success == false {
-			s.dstack.PushBool(false)
-			return nil
+		if s.verifySignature(hash, sigStr[:len(sigStr)-1], signature,
+			pkStr, pubKey) {
+			sigIdx++
+			signature = nil
 		}
 	}
 	s.dstack.PushBool(true)
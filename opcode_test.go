@@ -6,6 +6,7 @@ package btcscript_test
 
 import (
 	"bytes"
+	"errors"
 	"github.com/conformal/btcscript"
 	"github.com/conformal/btcwire"
 	"github.com/davecgh/go-spew/spew"
@@ -17,6 +18,7 @@ import (
 type opcodeTest struct {
 	script     []byte
 	canonical  bool
+	flags      btcscript.ScriptFlags
 	shouldPass bool
 	shouldFail error
 }
@@ -357,6 +359,19 @@ var opcodeTests = []opcodeTest{
 		shouldPass: true},
 	// No arguments also blows up
 	{script: []byte{btcscript.OP_NOT}, shouldPass: false},
+	// Numeric operands are limited to 4 bytes
+	{script: []byte{btcscript.OP_DATA_5, 0x01, 0x00, 0x00, 0x00, 0x00,
+		btcscript.OP_1, btcscript.OP_ADD},
+		shouldFail: btcscript.StackErrNumberTooBig},
+	{script: []byte{btcscript.OP_DATA_5, 0x01, 0x00, 0x00, 0x00, 0x00,
+		btcscript.OP_NOT}, shouldFail: btcscript.StackErrNumberTooBig},
+	// but results may overflow them so long as they aren't reused
+	{script: []byte{btcscript.OP_DATA_4, 0xff, 0xff, 0xff, 0x7f,
+		btcscript.OP_1ADD, btcscript.OP_DATA_5, 0x00, 0x00, 0x00, 0x80,
+		0x00, btcscript.OP_EQUAL}, shouldPass: true},
+	{script: []byte{btcscript.OP_DATA_4, 0xff, 0xff, 0xff, 0x7f,
+		btcscript.OP_1ADD, btcscript.OP_1ADD},
+		shouldFail: btcscript.StackErrNumberTooBig},
 
 	// Conditional Execution
 	{script: []byte{btcscript.OP_0, btcscript.OP_IF, btcscript.OP_0, btcscript.OP_ELSE, btcscript.OP_2, btcscript.OP_ENDIF}, shouldPass: true},
@@ -395,6 +410,18 @@ var opcodeTests = []opcodeTest{
 		btcscript.OP_1, btcscript.OP_CHECKMULTISIG},
 		canonical:  true,
 		shouldPass: false},
+	// an empty signature fails to verify instead of panicking.
+	{script: []byte{btcscript.OP_0, btcscript.OP_0, btcscript.OP_1,
+		btcscript.OP_DATA_65,
+		0x04, 0xae, 0x1a, 0x62, 0xfe, 0x09, 0xc5, 0xf5, 0x1b, 0x13,
+		0x90, 0x5f, 0x07, 0xf0, 0x6b, 0x99, 0xa2, 0xf7, 0x15, 0x9b,
+		0x22, 0x25, 0xf3, 0x74, 0xcd, 0x37, 0x8d, 0x71, 0x30, 0x2f,
+		0xa2, 0x84, 0x14, 0xe7, 0xaa, 0xb3, 0x73, 0x97, 0xf5, 0x54,
+		0xa7, 0xdf, 0x5f, 0x14, 0x2c, 0x21, 0xc1, 0xb7, 0x30, 0x3b,
+		0x8a, 0x06, 0x26, 0xf1, 0xba, 0xde, 0xd5, 0xc7, 0x2a, 0x70,
+		0x4f, 0x7e, 0x6c, 0xd8, 0x4c,
+		btcscript.OP_1, btcscript.OP_CHECKMULTISIG},
+		shouldFail: btcscript.StackErrScriptFailed},
 	/* up here because no defined error case. */
 	{script: []byte{btcscript.OP_1, btcscript.OP_1, btcscript.OP_DATA_65,
 		0x04, 0xae, 0x1a, 0x62, 0xfe, 0x09, 0xc5, 0xf5, 0x1b, 0x13,
@@ -407,6 +434,125 @@ var opcodeTests = []opcodeTest{
 		btcscript.OP_1, btcscript.OP_CHECKMULTISIGVERIFY},
 		shouldPass: false},
 
+	// Minimal data pushes and numbers.
+	{script: []byte{btcscript.OP_PUSHDATA1, 0x01, 0x05}, shouldPass: true},
+	{script: []byte{btcscript.OP_PUSHDATA1, 0x01, 0x05},
+		flags:      btcscript.ScriptVerifyMinimalData,
+		shouldFail: btcscript.StackErrMinimalPush},
+	{script: []byte{btcscript.OP_PUSHDATA1, 0x00, btcscript.OP_1},
+		flags:      btcscript.ScriptVerifyMinimalData,
+		shouldFail: btcscript.StackErrMinimalPush},
+	{script: []byte{btcscript.OP_DATA_1, 0x05},
+		flags:      btcscript.ScriptVerifyMinimalData,
+		shouldFail: btcscript.StackErrMinimalPush},
+	{script: []byte{btcscript.OP_DATA_1, 0x81},
+		flags:      btcscript.ScriptVerifyMinimalData,
+		shouldFail: btcscript.StackErrMinimalPush},
+	{script: []byte{btcscript.OP_PUSHDATA2, 0x03, 0x00, 0x01, 0x02, 0x03},
+		flags:      btcscript.ScriptVerifyMinimalData,
+		shouldFail: btcscript.StackErrMinimalPush},
+	{script: []byte{btcscript.OP_DATA_1, 0x00, btcscript.OP_DROP,
+		btcscript.OP_DATA_1, 0x11},
+		flags:      btcscript.ScriptVerifyMinimalData,
+		shouldPass: true},
+	{script: []byte{btcscript.OP_DATA_2, 0x01, 0x00, btcscript.OP_1ADD},
+		shouldPass: true},
+	{script: []byte{btcscript.OP_DATA_2, 0x01, 0x00, btcscript.OP_1ADD},
+		flags:      btcscript.ScriptVerifyMinimalData,
+		shouldFail: btcscript.StackErrMinimalData},
+	{script: []byte{btcscript.OP_DATA_2, 0x80, 0x00, btcscript.OP_1ADD},
+		flags:      btcscript.ScriptVerifyMinimalData,
+		shouldPass: true},
+
+	// Multisig dummy element.
+	{script: []byte{btcscript.OP_1, btcscript.OP_0, btcscript.OP_0,
+		btcscript.OP_CHECKMULTISIG}, shouldPass: true},
+	{script: []byte{btcscript.OP_1, btcscript.OP_0, btcscript.OP_0,
+		btcscript.OP_CHECKMULTISIG},
+		flags:      btcscript.ScriptVerifyNullDummy,
+		shouldFail: btcscript.StackErrNullDummy},
+	{script: []byte{btcscript.OP_0, btcscript.OP_0, btcscript.OP_0,
+		btcscript.OP_CHECKMULTISIG},
+		flags:      btcscript.ScriptVerifyNullDummy,
+		shouldPass: true},
+	{script: []byte{btcscript.OP_0, btcscript.OP_0,
+		btcscript.OP_CHECKMULTISIG},
+		shouldFail: btcscript.StackErrUnderflow},
+	{script: []byte{btcscript.OP_0, btcscript.OP_0,
+		btcscript.OP_CHECKMULTISIGVERIFY, btcscript.OP_1},
+		shouldFail: btcscript.StackErrUnderflow},
+
+	// Failed signature checks with empty signatures.
+	{script: []byte{btcscript.OP_0, btcscript.OP_DATA_65,
+		0x04, 0xae, 0x1a, 0x62, 0xfe, 0x09, 0xc5, 0xf5, 0x1b, 0x13,
+		0x90, 0x5f, 0x07, 0xf0, 0x6b, 0x99, 0xa2, 0xf7, 0x15, 0x9b,
+		0x22, 0x25, 0xf3, 0x74, 0xcd, 0x37, 0x8d, 0x71, 0x30, 0x2f,
+		0xa2, 0x84, 0x14, 0xe7, 0xaa, 0xb3, 0x73, 0x97, 0xf5, 0x54,
+		0xa7, 0xdf, 0x5f, 0x14, 0x2c, 0x21, 0xc1, 0xb7, 0x30, 0x3b,
+		0x8a, 0x06, 0x26, 0xf1, 0xba, 0xde, 0xd5, 0xc7, 0x2a, 0x70,
+		0x4f, 0x7e, 0x6c, 0xd8, 0x4c,
+		btcscript.OP_CHECKSIG, btcscript.OP_NOT},
+		flags:      btcscript.ScriptVerifyNullFail,
+		shouldPass: true},
+	{script: []byte{btcscript.OP_0, btcscript.OP_0, btcscript.OP_1,
+		btcscript.OP_DATA_65,
+		0x04, 0xae, 0x1a, 0x62, 0xfe, 0x09, 0xc5, 0xf5, 0x1b, 0x13,
+		0x90, 0x5f, 0x07, 0xf0, 0x6b, 0x99, 0xa2, 0xf7, 0x15, 0x9b,
+		0x22, 0x25, 0xf3, 0x74, 0xcd, 0x37, 0x8d, 0x71, 0x30, 0x2f,
+		0xa2, 0x84, 0x14, 0xe7, 0xaa, 0xb3, 0x73, 0x97, 0xf5, 0x54,
+		0xa7, 0xdf, 0x5f, 0x14, 0x2c, 0x21, 0xc1, 0xb7, 0x30, 0x3b,
+		0x8a, 0x06, 0x26, 0xf1, 0xba, 0xde, 0xd5, 0xc7, 0x2a, 0x70,
+		0x4f, 0x7e, 0x6c, 0xd8, 0x4c,
+		btcscript.OP_1, btcscript.OP_CHECKMULTISIG, btcscript.OP_NOT},
+		flags:      btcscript.ScriptVerifyNullFail,
+		shouldPass: true},
+
+	// Minimal OP_IF and OP_NOTIF arguments.
+	{script: []byte{btcscript.OP_2, btcscript.OP_IF, btcscript.OP_1,
+		btcscript.OP_ENDIF}, shouldPass: true},
+	{script: []byte{btcscript.OP_2, btcscript.OP_IF, btcscript.OP_1,
+		btcscript.OP_ENDIF},
+		flags:      btcscript.ScriptVerifyMinimalIf,
+		shouldFail: btcscript.StackErrMinimalIf},
+	{script: []byte{btcscript.OP_DATA_1, 0x00, btcscript.OP_NOTIF,
+		btcscript.OP_1, btcscript.OP_ENDIF},
+		flags:      btcscript.ScriptVerifyMinimalIf,
+		shouldFail: btcscript.StackErrMinimalIf},
+	{script: []byte{btcscript.OP_DATA_2, 0x01, 0x00, btcscript.OP_IF,
+		btcscript.OP_1, btcscript.OP_ENDIF},
+		flags:      btcscript.ScriptVerifyMinimalIf,
+		shouldFail: btcscript.StackErrMinimalIf},
+	{script: []byte{btcscript.OP_1, btcscript.OP_IF, btcscript.OP_1,
+		btcscript.OP_ENDIF},
+		flags:      btcscript.ScriptVerifyMinimalIf,
+		shouldPass: true},
+	{script: []byte{btcscript.OP_0, btcscript.OP_NOTIF, btcscript.OP_1,
+		btcscript.OP_ENDIF},
+		flags:      btcscript.ScriptVerifyMinimalIf,
+		shouldPass: true},
+
+	// Upgradable NOPs.
+	{script: []byte{btcscript.OP_NOP1, btcscript.OP_1}, shouldPass: true},
+	{script: []byte{btcscript.OP_NOP1, btcscript.OP_1},
+		flags:      btcscript.ScriptDiscourageUpgradableNops,
+		shouldFail: btcscript.StackErrDiscourageUpgradableNops},
+	{script: []byte{btcscript.OP_NOP10, btcscript.OP_1},
+		flags:      btcscript.ScriptDiscourageUpgradableNops,
+		shouldFail: btcscript.StackErrDiscourageUpgradableNops},
+	{script: []byte{btcscript.OP_1, btcscript.OP_NOP2},
+		flags:      btcscript.ScriptDiscourageUpgradableNops,
+		shouldFail: btcscript.StackErrDiscourageUpgradableNops},
+	{script: []byte{btcscript.OP_1, btcscript.OP_NOP3},
+		flags:      btcscript.ScriptDiscourageUpgradableNops,
+		shouldFail: btcscript.StackErrDiscourageUpgradableNops},
+	{script: []byte{btcscript.OP_NOP, btcscript.OP_1},
+		flags:      btcscript.ScriptDiscourageUpgradableNops,
+		shouldPass: true},
+	{script: []byte{btcscript.OP_0, btcscript.OP_IF, btcscript.OP_NOP4,
+		btcscript.OP_ENDIF, btcscript.OP_1},
+		flags:      btcscript.ScriptDiscourageUpgradableNops,
+		shouldPass: true},
+
 	// Invalid Opcodes
 	{script: []byte{186}, shouldPass: false},
 	{script: []byte{187}, shouldPass: false},
@@ -478,7 +624,7 @@ var opcodeTests = []opcodeTest{
 	{script: []byte{252}, shouldPass: false},
 }
 
-func testScript(t *testing.T, script []byte, canonical bool) (err error) {
+func testScript(t *testing.T, script []byte, flags btcscript.ScriptFlags) (err error) {
 	// mock up fake tx.
 	tx := &btcwire.MsgTx{
 		Version: 1,
@@ -503,11 +649,6 @@ func testScript(t *testing.T, script []byte, canonical bool) (err error) {
 
 	tx.TxOut[0].PkScript = script
 
-	var flags btcscript.ScriptFlags
-	if canonical {
-		flags = btcscript.ScriptCanonicalSignatures
-	}
-
 	engine, err := btcscript.NewScript(tx.TxIn[0].SignatureScript,
 		tx.TxOut[0].PkScript, 0, tx, flags)
 	if err != nil {
@@ -521,11 +662,15 @@ func TestScripts(t *testing.T) {
 	for i := range opcodeTests {
 		shouldPass := opcodeTests[i].shouldPass
 		shouldFail := opcodeTests[i].shouldFail
-		err := testScript(t, opcodeTests[i].script, opcodeTests[i].canonical)
+		flags := opcodeTests[i].flags
+		if opcodeTests[i].canonical {
+			flags |= btcscript.ScriptCanonicalSignatures
+		}
+		err := testScript(t, opcodeTests[i].script, flags)
 		if shouldFail != nil {
 			if err == nil {
 				t.Errorf("test %d passed should fail with %v", i, err)
-			} else if shouldFail != err {
+			} else if !errors.Is(err, shouldFail) {
 				t.Errorf("test %d failed with wrong error [%v], expected [%v]", i, err, shouldFail)
 			}
 		}
@@ -537,6 +682,441 @@ func TestScripts(t *testing.T) {
 	}
 }
 
+// TestStackSizeLimit ensures scripts fail once the combined size of the data
+// and alt stacks goes over MaxStackSize, and not before.
+func TestStackSizeLimit(t *testing.T) {
+	tests := []struct {
+		name   string
+		script []byte
+		err    error
+	}{
+		{
+			name: "dup to limit",
+			script: append(bytes.Repeat([]byte{btcscript.OP_1}, 999),
+				btcscript.OP_DUP),
+		},
+		{
+			name: "dup past limit",
+			script: append(bytes.Repeat([]byte{btcscript.OP_1}, 1000),
+				btcscript.OP_DUP),
+			err: btcscript.StackErrStackOverflow,
+		},
+		{
+			name: "3dup loop to limit",
+			script: append(bytes.Repeat([]byte{btcscript.OP_1}, 700),
+				bytes.Repeat([]byte{btcscript.OP_3DUP}, 100)...),
+		},
+		{
+			name: "3dup loop past limit",
+			script: append(bytes.Repeat([]byte{btcscript.OP_1}, 700),
+				bytes.Repeat([]byte{btcscript.OP_3DUP}, 101)...),
+			err: btcscript.StackErrStackOverflow,
+		},
+		{
+			name: "push past limit",
+			script: bytes.Repeat([]byte{btcscript.OP_1},
+				btcscript.MaxStackSize+1),
+			err: btcscript.StackErrStackOverflow,
+		},
+		{
+			name: "alt stack to limit",
+			script: append(bytes.Repeat([]byte{btcscript.OP_1}, 999),
+				btcscript.OP_TOALTSTACK, btcscript.OP_1),
+		},
+		{
+			name: "alt stack past limit",
+			script: append(bytes.Repeat([]byte{btcscript.OP_1}, 999),
+				btcscript.OP_TOALTSTACK, btcscript.OP_1,
+				btcscript.OP_DUP),
+			err: btcscript.StackErrStackOverflow,
+		},
+	}
+
+	for _, test := range tests {
+		err := testScript(t, test.script, 0)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got error [%v], expected [%v]", test.name,
+				err, test.err)
+		}
+	}
+}
+
+// TestUnexecutedBranches ensures that disabled opcodes, oversized pushes and
+// the operation count are enforced in branches which are not executed, and
+// that overly large scripts are rejected.
+func TestUnexecutedBranches(t *testing.T) {
+	bigPush := append([]byte{btcscript.OP_PUSHDATA2, 0x09, 0x02},
+		make([]byte, btcscript.MaxScriptElementSize+1)...)
+	maxPush := append([]byte{btcscript.OP_PUSHDATA2, 0x08, 0x02},
+		make([]byte, btcscript.MaxScriptElementSize)...)
+
+	// 19 max pushes and drops take up 9956 bytes, so pad out the rest.
+	maxScript := bytes.Repeat(append(maxPush, btcscript.OP_DROP), 19)
+	maxScript = append(maxScript, bytes.Repeat([]byte{btcscript.OP_NOP},
+		btcscript.MaxScriptSize-len(maxScript)-1)...)
+	maxScript = append(maxScript, btcscript.OP_1)
+
+	tests := []struct {
+		name   string
+		script []byte
+		err    error
+	}{
+		{
+			name: "disabled opcode in unexecuted branch",
+			script: []byte{btcscript.OP_0, btcscript.OP_IF,
+				btcscript.OP_CAT, btcscript.OP_ENDIF,
+				btcscript.OP_1},
+			err: btcscript.StackErrOpDisabled,
+		},
+		{
+			name: "disabled opcode in unexecuted else",
+			script: []byte{btcscript.OP_1, btcscript.OP_IF,
+				btcscript.OP_1, btcscript.OP_ELSE,
+				btcscript.OP_2MUL, btcscript.OP_ENDIF},
+			err: btcscript.StackErrOpDisabled,
+		},
+		{
+			name: "OP_VERIF in unexecuted branch",
+			script: []byte{btcscript.OP_0, btcscript.OP_IF,
+				btcscript.OP_VERIF, btcscript.OP_ENDIF,
+				btcscript.OP_1},
+			err: btcscript.StackErrReservedOpcode,
+		},
+		{
+			name: "reserved opcode in unexecuted branch",
+			script: []byte{btcscript.OP_0, btcscript.OP_IF,
+				btcscript.OP_VER, btcscript.OP_ENDIF,
+				btcscript.OP_1},
+		},
+		{
+			name: "oversized push in unexecuted branch",
+			script: append(append([]byte{btcscript.OP_0,
+				btcscript.OP_IF}, bigPush...),
+				btcscript.OP_ENDIF, btcscript.OP_1),
+			err: btcscript.StackErrElementTooBig,
+		},
+		{
+			name: "max push in unexecuted branch",
+			script: append(append([]byte{btcscript.OP_0,
+				btcscript.OP_IF}, maxPush...),
+				btcscript.OP_ENDIF, btcscript.OP_1),
+		},
+		{
+			name: "ops counted in unexecuted branch",
+			script: append(append([]byte{btcscript.OP_0,
+				btcscript.OP_IF}, bytes.Repeat(
+				[]byte{btcscript.OP_NOP}, 200)...),
+				btcscript.OP_ENDIF, btcscript.OP_1),
+			err: btcscript.StackErrTooManyOperations,
+		},
+		{
+			name: "max ops with unexecuted branch",
+			script: append(append([]byte{btcscript.OP_0,
+				btcscript.OP_IF}, bytes.Repeat(
+				[]byte{btcscript.OP_NOP}, 199)...),
+				btcscript.OP_ENDIF, btcscript.OP_1),
+		},
+		{
+			name:   "max script size",
+			script: maxScript,
+		},
+		{
+			name: "script too big",
+			script: append([]byte{btcscript.OP_NOP},
+				maxScript...),
+			err: btcscript.StackErrScriptTooBig,
+		},
+	}
+
+	for _, test := range tests {
+		err := testScript(t, test.script, 0)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got error [%v], expected [%v]", test.name,
+				err, test.err)
+		}
+	}
+}
+
+// lockTimeTest describes a script to be run against a fake tx with a single
+// input and output where the tx version, lock time and input sequence number
+// are given by the test.  A nil err means the script should pass.
+type lockTimeTest struct {
+	name     string
+	script   []byte
+	version  uint32
+	lockTime uint32
+	sequence uint32
+	flags    btcscript.ScriptFlags
+	err      error
+}
+
+var lockTimeTests = []lockTimeTest{
+	{
+		name: "cltv disabled is a nop",
+		script: []byte{btcscript.OP_DATA_1, 0x64,
+			btcscript.OP_CHECKLOCKTIMEVERIFY, btcscript.OP_DROP,
+			btcscript.OP_TRUE},
+		version:  1,
+		lockTime: 0,
+		sequence: 0xffffffff,
+	},
+	{
+		name:     "cltv disabled with empty stack",
+		script:   []byte{btcscript.OP_CHECKLOCKTIMEVERIFY, btcscript.OP_TRUE},
+		version:  1,
+		sequence: 0xffffffff,
+	},
+	{
+		name: "cltv height satisfied",
+		script: []byte{btcscript.OP_DATA_1, 0x64,
+			btcscript.OP_CHECKLOCKTIMEVERIFY, btcscript.OP_DROP,
+			btcscript.OP_TRUE},
+		version:  1,
+		lockTime: 100,
+		sequence: 0,
+		flags:    btcscript.ScriptVerifyCheckLockTimeVerify,
+	},
+	{
+		name: "cltv height not reached",
+		script: []byte{btcscript.OP_DATA_1, 0x64,
+			btcscript.OP_CHECKLOCKTIMEVERIFY, btcscript.OP_DROP,
+			btcscript.OP_TRUE},
+		version:  1,
+		lockTime: 99,
+		sequence: 0,
+		flags:    btcscript.ScriptVerifyCheckLockTimeVerify,
+		err:      btcscript.StackErrUnsatisfiedLockTime,
+	},
+	{
+		name: "cltv time satisfied",
+		script: []byte{btcscript.OP_DATA_4, 0x00, 0x65, 0xcd, 0x1d,
+			btcscript.OP_CHECKLOCKTIMEVERIFY, btcscript.OP_DROP,
+			btcscript.OP_TRUE},
+		version:  1,
+		lockTime: 500000001,
+		sequence: 0,
+		flags:    btcscript.ScriptVerifyCheckLockTimeVerify,
+	},
+	{
+		name: "cltv time against height",
+		script: []byte{btcscript.OP_DATA_4, 0x00, 0x65, 0xcd, 0x1d,
+			btcscript.OP_CHECKLOCKTIMEVERIFY, btcscript.OP_DROP,
+			btcscript.OP_TRUE},
+		version:  1,
+		lockTime: 100,
+		sequence: 0,
+		flags:    btcscript.ScriptVerifyCheckLockTimeVerify,
+		err:      btcscript.StackErrUnsatisfiedLockTime,
+	},
+	{
+		name: "cltv height against time",
+		script: []byte{btcscript.OP_DATA_1, 0x64,
+			btcscript.OP_CHECKLOCKTIMEVERIFY, btcscript.OP_DROP,
+			btcscript.OP_TRUE},
+		version:  1,
+		lockTime: 500000000,
+		sequence: 0,
+		flags:    btcscript.ScriptVerifyCheckLockTimeVerify,
+		err:      btcscript.StackErrUnsatisfiedLockTime,
+	},
+	{
+		name: "cltv max lock time in 5 bytes",
+		script: []byte{btcscript.OP_DATA_5, 0xff, 0xff, 0xff, 0xff,
+			0x00, btcscript.OP_CHECKLOCKTIMEVERIFY, btcscript.OP_DROP,
+			btcscript.OP_TRUE},
+		version:  1,
+		lockTime: 0xffffffff,
+		sequence: 0,
+		flags:    btcscript.ScriptVerifyCheckLockTimeVerify,
+	},
+	{
+		name: "cltv final sequence",
+		script: []byte{btcscript.OP_DATA_1, 0x64,
+			btcscript.OP_CHECKLOCKTIMEVERIFY, btcscript.OP_DROP,
+			btcscript.OP_TRUE},
+		version:  1,
+		lockTime: 100,
+		sequence: 0xffffffff,
+		flags:    btcscript.ScriptVerifyCheckLockTimeVerify,
+		err:      btcscript.StackErrUnsatisfiedLockTime,
+	},
+	{
+		name: "cltv negative",
+		script: []byte{btcscript.OP_1NEGATE,
+			btcscript.OP_CHECKLOCKTIMEVERIFY, btcscript.OP_DROP,
+			btcscript.OP_TRUE},
+		version:  1,
+		lockTime: 100,
+		sequence: 0,
+		flags:    btcscript.ScriptVerifyCheckLockTimeVerify,
+		err:      btcscript.StackErrNegativeLockTime,
+	},
+	{
+		name: "cltv 6 byte number",
+		script: []byte{btcscript.OP_DATA_6, 0x01, 0x00, 0x00, 0x00,
+			0x00, 0x00, btcscript.OP_CHECKLOCKTIMEVERIFY,
+			btcscript.OP_DROP, btcscript.OP_TRUE},
+		version:  1,
+		lockTime: 100,
+		sequence: 0,
+		flags:    btcscript.ScriptVerifyCheckLockTimeVerify,
+		err:      btcscript.StackErrNumberTooBig,
+	},
+	{
+		name:     "cltv empty stack",
+		script:   []byte{btcscript.OP_CHECKLOCKTIMEVERIFY},
+		version:  1,
+		lockTime: 100,
+		sequence: 0,
+		flags:    btcscript.ScriptVerifyCheckLockTimeVerify,
+		err:      btcscript.StackErrUnderflow,
+	},
+	{
+		name: "csv disabled is a nop",
+		script: []byte{btcscript.OP_DATA_1, 0x0a,
+			btcscript.OP_CHECKSEQUENCEVERIFY, btcscript.OP_DROP,
+			btcscript.OP_TRUE},
+		version:  1,
+		sequence: 0xffffffff,
+	},
+	{
+		name: "csv blocks satisfied",
+		script: []byte{btcscript.OP_DATA_1, 0x0a,
+			btcscript.OP_CHECKSEQUENCEVERIFY, btcscript.OP_DROP,
+			btcscript.OP_TRUE},
+		version:  2,
+		sequence: 10,
+		flags:    btcscript.ScriptVerifyCheckSequenceVerify,
+	},
+	{
+		name: "csv blocks not reached",
+		script: []byte{btcscript.OP_DATA_1, 0x0a,
+			btcscript.OP_CHECKSEQUENCEVERIFY, btcscript.OP_DROP,
+			btcscript.OP_TRUE},
+		version:  2,
+		sequence: 9,
+		flags:    btcscript.ScriptVerifyCheckSequenceVerify,
+		err:      btcscript.StackErrUnsatisfiedLockTime,
+	},
+	{
+		name: "csv ignores bits outside mask",
+		script: []byte{btcscript.OP_DATA_1, 0x0a,
+			btcscript.OP_CHECKSEQUENCEVERIFY, btcscript.OP_DROP,
+			btcscript.OP_TRUE},
+		version:  2,
+		sequence: 0x0001000a,
+		flags:    btcscript.ScriptVerifyCheckSequenceVerify,
+	},
+	{
+		name: "csv seconds satisfied",
+		script: []byte{btcscript.OP_DATA_3, 0x0a, 0x00, 0x40,
+			btcscript.OP_CHECKSEQUENCEVERIFY, btcscript.OP_DROP,
+			btcscript.OP_TRUE},
+		version:  2,
+		sequence: 0x0040000a,
+		flags:    btcscript.ScriptVerifyCheckSequenceVerify,
+	},
+	{
+		name: "csv seconds against blocks",
+		script: []byte{btcscript.OP_DATA_3, 0x0a, 0x00, 0x40,
+			btcscript.OP_CHECKSEQUENCEVERIFY, btcscript.OP_DROP,
+			btcscript.OP_TRUE},
+		version:  2,
+		sequence: 100,
+		flags:    btcscript.ScriptVerifyCheckSequenceVerify,
+		err:      btcscript.StackErrUnsatisfiedLockTime,
+	},
+	{
+		name: "csv tx version 1",
+		script: []byte{btcscript.OP_DATA_1, 0x0a,
+			btcscript.OP_CHECKSEQUENCEVERIFY, btcscript.OP_DROP,
+			btcscript.OP_TRUE},
+		version:  1,
+		sequence: 10,
+		flags:    btcscript.ScriptVerifyCheckSequenceVerify,
+		err:      btcscript.StackErrUnsatisfiedLockTime,
+	},
+	{
+		name: "csv input disabled",
+		script: []byte{btcscript.OP_DATA_1, 0x0a,
+			btcscript.OP_CHECKSEQUENCEVERIFY, btcscript.OP_DROP,
+			btcscript.OP_TRUE},
+		version:  2,
+		sequence: 0x8000000a,
+		flags:    btcscript.ScriptVerifyCheckSequenceVerify,
+		err:      btcscript.StackErrUnsatisfiedLockTime,
+	},
+	{
+		name: "csv operand disabled",
+		script: []byte{btcscript.OP_DATA_5, 0x00, 0x00, 0x00, 0x80,
+			0x00, btcscript.OP_CHECKSEQUENCEVERIFY, btcscript.OP_DROP,
+			btcscript.OP_TRUE},
+		version:  1,
+		sequence: 0xffffffff,
+		flags:    btcscript.ScriptVerifyCheckSequenceVerify,
+	},
+	{
+		name: "csv negative",
+		script: []byte{btcscript.OP_1NEGATE,
+			btcscript.OP_CHECKSEQUENCEVERIFY, btcscript.OP_DROP,
+			btcscript.OP_TRUE},
+		version:  2,
+		sequence: 10,
+		flags:    btcscript.ScriptVerifyCheckSequenceVerify,
+		err:      btcscript.StackErrNegativeLockTime,
+	},
+	{
+		name:     "csv empty stack",
+		script:   []byte{btcscript.OP_CHECKSEQUENCEVERIFY},
+		version:  2,
+		sequence: 10,
+		flags:    btcscript.ScriptVerifyCheckSequenceVerify,
+		err:      btcscript.StackErrUnderflow,
+	},
+}
+
+func testLockTime(t *testing.T, test *lockTimeTest) {
+	// mock up fake tx.
+	tx := &btcwire.MsgTx{
+		Version: test.version,
+		TxIn: []*btcwire.TxIn{
+			&btcwire.TxIn{
+				PreviousOutpoint: btcwire.OutPoint{
+					Hash:  btcwire.ShaHash{},
+					Index: 0xffffffff,
+				},
+				SignatureScript: []byte{},
+				Sequence:        test.sequence,
+			},
+		},
+		TxOut: []*btcwire.TxOut{
+			&btcwire.TxOut{
+				Value:    0x12a05f200,
+				PkScript: []byte{},
+			},
+		},
+		LockTime: test.lockTime,
+	}
+
+	engine, err := btcscript.NewScript(tx.TxIn[0].SignatureScript,
+		test.script, 0, tx, test.flags)
+	if err != nil {
+		t.Errorf("%s: failed to create script: %v", test.name, err)
+		return
+	}
+	err = engine.Execute()
+	if !errors.Is(err, test.err) {
+		t.Errorf("%s: got error [%v], expected [%v]", test.name, err,
+			test.err)
+	}
+}
+
+func TestLockTimes(t *testing.T) {
+	for i := range lockTimeTests {
+		testLockTime(t, &lockTimeTests[i])
+	}
+}
+
 // Detailed tests for opcodes, we inspect machine state before and after the
 // opcode and check that it has the effect on the state that we expect.
 type detailedTest struct {
@@ -3422,10 +4002,10 @@ var detailedTests = []detailedTest{
 	},
 	// Invalid Opcodes
 	{
-		name:           "invalid opcode 186",
-		script:         []byte{btcscript.OP_UNKNOWN186},
+		name:           "OP_CHECKSIGADD outside tapscript",
+		script:         []byte{btcscript.OP_CHECKSIGADD},
 		expectedReturn: btcscript.StackErrInvalidOpcode,
-		disassembly:    "OP_UNKNOWN186",
+		disassembly:    "OP_CHECKSIGADD",
 	},
 	{
 		name:           "invalid opcode 187",
@@ -3825,10 +4405,10 @@ var detailedTests = []detailedTest{
 	},
 
 	{
-		name:        "invalid opcode 186 if noexec",
-		script:      []byte{btcscript.OP_FALSE, btcscript.OP_IF, btcscript.OP_UNKNOWN186, btcscript.OP_ELSE, btcscript.OP_TRUE, btcscript.OP_ENDIF},
+		name:        "OP_CHECKSIGADD outside tapscript if noexec",
+		script:      []byte{btcscript.OP_FALSE, btcscript.OP_IF, btcscript.OP_CHECKSIGADD, btcscript.OP_ELSE, btcscript.OP_TRUE, btcscript.OP_ENDIF},
 		after:       [][]byte{{0x01}},
-		disassembly: "0 OP_IF OP_UNKNOWN186 OP_ELSE 1 OP_ENDIF",
+		disassembly: "0 OP_IF OP_CHECKSIGADD OP_ELSE 1 OP_ENDIF",
 	},
 	{
 		name:        "invalid opcode 187 if noexec",
@@ -4339,7 +4919,7 @@ func testOpcode(t *testing.T, test *detailedTest) {
 
 		done, err = engine.Step()
 		if err != nil {
-			if err != test.expectedReturn {
+			if !errors.Is(err, test.expectedReturn) {
 				t.Errorf("Error return not expected %s: %v %v",
 					test.name, test.expectedReturn, err)
 				return
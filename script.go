@@ -8,7 +8,6 @@ import (
 	"bytes"
 	"crypto/ecdsa"
 	"crypto/rand"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"github.com/conformal/btcec"
@@ -116,6 +115,139 @@ var (
 	// StackErrNonPushOnly is returned when ScriptInfo is called with a
 	// pkScript that peforms operations other that pushing data to the stack.
 	StackErrNonPushOnly = errors.New("SigScript is non pushonly")
+
+	// StackErrNegativeLockTime is returned when OP_CHECKLOCKTIMEVERIFY is
+	// executed with a negative lock time on top of the stack.
+	StackErrNegativeLockTime = errors.New("negative lock time")
+
+	// StackErrUnsatisfiedLockTime is returned when OP_CHECKLOCKTIMEVERIFY
+	// is executed and the lock time of the transaction does not satisfy
+	// the one required by the script.
+	StackErrUnsatisfiedLockTime = errors.New("lock time requirement not " +
+		"satisfied")
+
+	// StackErrStackOverflow is returned when the combined number of items
+	// on the data and alt stacks exceeds MaxStackSize after an opcode.
+	StackErrStackOverflow = errors.New("combined stack size exceeded")
+
+	// StackErrScriptTooBig is returned if a script is larger than
+	// MaxScriptSize.
+	StackErrScriptTooBig = errors.New("script is too large")
+
+	// StackErrMinimalData is returned when a number is required to be
+	// minimally encoded and is not.
+	StackErrMinimalData = errors.New("non-minimally encoded script number")
+
+	// StackErrMinimalPush is returned when ScriptVerifyMinimalData is set
+	// and data is pushed with a larger opcode than needed.
+	StackErrMinimalPush = errors.New("data push is not minimally encoded")
+
+	// StackErrNullDummy is returned when ScriptVerifyNullDummy is set and
+	// the extra element consumed by OP_CHECKMULTISIG is not empty.
+	StackErrNullDummy = errors.New("multisig dummy argument is not empty")
+
+	// StackErrCleanStack is returned when ScriptVerifyCleanStack is set
+	// and more than the single result is left on the stack after the
+	// scripts have run.
+	StackErrCleanStack = errors.New("stack not clean after execution")
+
+	// StackErrNullFail is returned when ScriptVerifyNullFail is set and a
+	// signature check fails with a signature that is not empty.
+	StackErrNullFail = errors.New("signature must be empty when the " +
+		"check fails")
+
+	// StackErrMinimalIf is returned when ScriptVerifyMinimalIf is set and
+	// the argument of OP_IF or OP_NOTIF is neither empty nor 0x01.
+	StackErrMinimalIf = errors.New("OP_IF argument is not minimal")
+
+	// StackErrDiscourageUpgradableNops is returned when
+	// ScriptDiscourageUpgradableNops is set and one of the NOP opcodes
+	// reserved for soft forks is executed.
+	StackErrDiscourageUpgradableNops = errors.New("upgradable NOP " +
+		"opcode executed")
+
+	// StackErrWitnessMalleated is returned when ScriptVerifyWitness is set
+	// and a native witness program is spent with a signature script that
+	// is not empty.
+	StackErrWitnessMalleated = errors.New("native witness program spent " +
+		"with non-empty signature script")
+
+	// StackErrWitnessMalleatedP2SH is returned when ScriptVerifyWitness is
+	// set and a pay-to-script-hash output whose redeem script is a witness
+	// program is spent with a signature script that holds anything but a
+	// single direct push of the redeem script.
+	StackErrWitnessMalleatedP2SH = errors.New("pay to script hash " +
+		"witness program spent with a signature script that is not " +
+		"a single push of the redeem script")
+
+	// StackErrWitnessUnexpected is returned when ScriptVerifyWitness is set
+	// and a witness is given for a pkScript that is not a witness program.
+	StackErrWitnessUnexpected = errors.New("witness provided for " +
+		"non-witness script")
+
+	// StackErrWitnessProgramEmpty is returned when a pay-to-witness-
+	// script-hash program is spent with an empty witness.
+	StackErrWitnessProgramEmpty = errors.New("witness is empty for " +
+		"witness script hash program")
+
+	// StackErrWitnessProgramMismatch is returned when the witness does not
+	// match the witness program, either because the witness script does
+	// not hash to the program or because a pay-to-witness-pubkey-hash
+	// witness does not have two items.
+	StackErrWitnessProgramMismatch = errors.New("witness does not match " +
+		"witness program")
+
+	// StackErrWitnessProgramWrongLength is returned when a version 0
+	// witness program is neither 20 nor 32 bytes long.
+	StackErrWitnessProgramWrongLength = errors.New("invalid witness " +
+		"program length for version 0")
+
+	// StackErrInvalidPrevOuts is returned when the previous outputs given
+	// for a witness spend do not match the inputs of the transaction, one
+	// output for each of them.
+	StackErrInvalidPrevOuts = errors.New("previous outputs do not match " +
+		"transaction inputs")
+
+	// StackErrSchnorrSigSize is returned when a taproot signature is
+	// neither 64 nor 65 bytes long.
+	StackErrSchnorrSigSize = errors.New("invalid schnorr signature size")
+
+	// StackErrSchnorrSigHashType is returned when a taproot signature has
+	// a hash type that is not defined, or SigHashSingle without a
+	// matching output.
+	StackErrSchnorrSigHashType = errors.New("invalid schnorr signature " +
+		"hash type")
+
+	// StackErrSchnorrSig is returned when a taproot signature does not
+	// verify.
+	StackErrSchnorrSig = errors.New("invalid schnorr signature")
+
+	// StackErrHighS is returned when ScriptVerifyLowS is set and a
+	// signature has an S value greater than half the curve order.
+	StackErrHighS = errors.New("signature S value is unnecessarily high")
+
+	// StackErrInvalidSigHashType is returned when ScriptVerifyStrictEncoding
+	// is set and a signature has a hashtype that is not defined.
+	StackErrInvalidSigHashType = errors.New("invalid signature hash type")
+
+	// StackErrPubKeyType is returned when ScriptVerifyStrictEncoding is set
+	// and a public key is neither compressed nor uncompressed.
+	StackErrPubKeyType = errors.New("unsupported public key type")
+
+	// StackErrTaprootControlBlock is returned when the control block of a
+	// taproot script path spend has an invalid size.
+	StackErrTaprootControlBlock = errors.New("invalid taproot control " +
+		"block size")
+
+	// StackErrTaprootMaxSigOps is returned when a tapscript checks more
+	// signatures than the budget allowed by the size of its witness.
+	StackErrTaprootMaxSigOps = errors.New("tapscript signature operation " +
+		"budget exceeded")
+
+	// StackErrTapscriptCheckMultiSig is returned when OP_CHECKMULTISIG or
+	// OP_CHECKMULTISIGVERIFY is executed in a tapscript.
+	StackErrTapscriptCheckMultiSig = errors.New("OP_CHECKMULTISIG is " +
+		"disabled in tapscript")
 )
 
 // ErrUnsupportedAddress is returned when a concrete type that implements
@@ -138,9 +270,38 @@ const (
 
 // These are the constants specified for maximums in individual scripts.
 const (
-	MaxOpsPerScript       = 201 // Max number of non-push operations.
-	MaxPubKeysPerMultiSig = 20  // Multisig can't have more sigs than this.
-	MaxScriptElementSize  = 520 // Max bytes pushable to the stack.
+	MaxOpsPerScript       = 201   // Max number of non-push operations.
+	MaxPubKeysPerMultiSig = 20    // Multisig can't have more sigs than this.
+	MaxScriptElementSize  = 520   // Max bytes pushable to the stack.
+	MaxStackSize          = 1000  // Max combined height of stack and alt stack.
+	MaxScriptSize         = 10000 // Max length in bytes of a single script.
+)
+
+// LockTimeThreshold is the number below which a lock time is interpreted to be
+// a block height.  Lock times at or above it are unix timestamps.  This value
+// corresponds to Tue Nov 5 00:53:20 1985 UTC.
+const LockTimeThreshold = 500000000
+
+// These constants describe how the sequence number of a transaction input is
+// interpreted as a relative lock time (bip68) by OP_CHECKSEQUENCEVERIFY.
+const (
+	// SequenceLockTimeDisabled is the bit which, when set on a sequence
+	// number, means it carries no relative lock time.
+	SequenceLockTimeDisabled = 1 << 31
+
+	// SequenceLockTimeIsSeconds is the bit which, when set on a sequence
+	// number, means the relative lock time is in units of 512 seconds
+	// rather than blocks.
+	SequenceLockTimeIsSeconds = 1 << 22
+
+	// SequenceLockTimeMask masks the relative lock time value out of a
+	// sequence number.
+	SequenceLockTimeMask = 0x0000ffff
+
+	// SequenceLockTimeGranularity is the number of bits to shift a time
+	// based relative lock time to the left to get seconds, thus 512
+	// seconds per unit.
+	SequenceLockTimeGranularity = 9
 )
 
 // ScriptClass is an enumeration for the list of standard types of script.
@@ -190,6 +351,19 @@ type Script struct {
 	bip16           bool     // treat execution as pay-to-script-hash
 	der             bool     // enforce DER encoding
 	savedFirstStack [][]byte // stack from first script for bip16 scripts
+	flags           ScriptFlags
+	witness         TxWitness // witness of the input being spent
+	witnessVersion  int
+	witnessProgram  []byte           // program of a witness pkScript, nil otherwise
+	witnessScript   bool             // the witness script is running
+	prevOuts        []*btcwire.TxOut // outputs spent by the tx inputs
+	taprootAnnex    []byte           // annex of a taproot witness
+	tapLeafHash     []byte           // leaf hash of a running tapscript
+	tapCodeSepPos   uint32           // position of the last tapscript OP_CODESEPARATOR
+	sigOpsBudget    int              // remaining tapscript signature budget
+	sigCache        *SigCache        // cache of valid signatures, if any
+	sigHashes       *TxSigHashes     // signature hash state of tx
+	tracer          Tracer           // reported each opcode run, if set
 }
 
 // isPubkey returns true if the script passed is a pubkey transaction, false
@@ -379,7 +553,7 @@ func parseScriptTemplate(script []byte, opcodemap map[byte]*opcode) ([]parsedOpc
 			}
 
 			if err != nil {
-				return nil, err
+				return retScript, err
 			}
 			off = i + 1 - op.length // beginning of data
 			// Disallow entries that do not fit script or were
@@ -431,17 +605,149 @@ const (
 	// recognized by creator of the transaction.  Performing a canonical
 	// check enforces script signatures use a unique DER format.
 	ScriptCanonicalSignatures
+
+	// ScriptVerifyCheckLockTimeVerify defines whether OP_NOP2 is treated
+	// as OP_CHECKLOCKTIMEVERIFY (bip65), which makes an output unspendable
+	// until the lock time of the spending transaction has reached the
+	// value given in the script.  When it is not set OP_NOP2 remains a
+	// no-op so that historical scripts validate as they always have.
+	ScriptVerifyCheckLockTimeVerify
+
+	// ScriptVerifyCheckSequenceVerify defines whether OP_NOP3 is treated
+	// as OP_CHECKSEQUENCEVERIFY (bip112), which makes an output
+	// unspendable until the relative lock time (bip68) in the sequence
+	// number of the spending input has reached the value given in the
+	// script.  When it is not set OP_NOP3 remains a no-op.
+	ScriptVerifyCheckSequenceVerify
+
+	// ScriptVerifyLowS defines whether signatures are required to have an
+	// S value no greater than half the curve order (bip62, bip146).  For
+	// every valid signature (R, S), (R, N-S) is valid too, so without this
+	// check anyone can change the hash of a transaction in flight.  The
+	// check only makes sense on DER signatures, so the flag implies
+	// ScriptCanonicalSignatures.
+	ScriptVerifyLowS
+
+	// ScriptVerifyStrictEncoding defines whether signatures must carry one
+	// of the defined hash types and public keys must be in compressed or
+	// uncompressed form, rejecting the hybrid form btcec also accepts.
+	// Both are checked before any hash is computed.  Like
+	// ScriptVerifyLowS the flag implies ScriptCanonicalSignatures.
+	ScriptVerifyStrictEncoding
+
+	// ScriptVerifyMinimalData defines whether data pushes must use the
+	// smallest opcode that can push the data and numbers read from the
+	// stack must be minimally encoded (bip62).  Either could otherwise
+	// be re-encoded by a third party without invalidating the scripts.
+	ScriptVerifyMinimalData
+
+	// ScriptVerifyNullDummy defines whether the extra stack element that
+	// OP_CHECKMULTISIG and OP_CHECKMULTISIGVERIFY consume, due to an off
+	// by one in the original implementation, must be empty (bip147).
+	// Nothing else looks at it, so otherwise it can be replaced freely.
+	ScriptVerifyNullDummy
+
+	// ScriptVerifySigPushOnly defines whether every signature script must
+	// be push only, not just those spending pay-to-script-hash outputs.
+	// Execute fails with StackErrNonPushOnly otherwise.
+	ScriptVerifySigPushOnly
+
+	// ScriptVerifyCleanStack defines whether exactly one element, the
+	// result, must be left on the stack once all scripts have run.  Extra
+	// elements from the signature script could otherwise be added by
+	// anyone relaying the transaction.  Execute fails with
+	// StackErrCleanStack otherwise.  Like in bitcoind this should only be
+	// used together with ScriptBip16, since the items that pay-to-script-
+	// hash signature scripts push are not consumed by the pkScript.
+	ScriptVerifyCleanStack
+
+	// ScriptVerifyNullFail defines whether a failed OP_CHECKSIG or
+	// OP_CHECKMULTISIG is an error unless all of its signatures were
+	// empty.  The only way left to get false from a signature check is
+	// then to pass an empty signature, so a script cannot be made to take
+	// a different path by substituting an invalid signature.
+	ScriptVerifyNullFail
+
+	// ScriptVerifyMinimalIf defines whether the argument to OP_IF and
+	// OP_NOTIF must be exactly empty or 0x01, rather than anything that
+	// is interpreted as a boolean, so that it cannot be re-encoded.
+	ScriptVerifyMinimalIf
+
+	// ScriptDiscourageUpgradableNops defines whether executing OP_NOP1 or
+	// OP_NOP4 to OP_NOP10 is an error, as well as OP_NOP2 and OP_NOP3 when
+	// they are not enabled as OP_CHECKLOCKTIMEVERIFY and
+	// OP_CHECKSEQUENCEVERIFY.  These opcodes are reserved for soft forks,
+	// so this is a policy flag for relaying transactions: it must never be
+	// used to validate blocks, which may spend outputs using opcodes that
+	// have since been given a meaning.
+	ScriptDiscourageUpgradableNops
+
+	// ScriptVerifyWitness defines whether segregated witness (bip141)
+	// outputs are validated.  A pkScript that is a witness program is then
+	// spent by the witness given to NewScriptWithWitness: version 0
+	// programs of 20 bytes are pay-to-witness-pubkey-hash and of 32 bytes
+	// pay-to-witness-script-hash.  The signature script must be empty,
+	// witness items may be at most MaxScriptElementSize bytes and the
+	// witness script must leave exactly one true item on the stack.
+	// When it is not set witness programs are anyone-can-spend, as they
+	// were before the soft fork.
+	ScriptVerifyWitness
+
+	// ScriptVerifyTaproot defines whether spends of 32-byte version 1
+	// witness programs are validated as taproot (bip341) outputs, whose
+	// key path is spent by a bip340 schnorr signature for the output key.
+	// It has no effect without ScriptVerifyWitness.
+	ScriptVerifyTaproot
 )
 
+// ScriptOption is an optional setting of a script engine, given to NewScript
+// or NewScriptWithWitness.
+type ScriptOption func(*Script)
+
+// WithSigCache returns an option that has the script engine look up ecdsa
+// signatures in sigCache before verifying them, and add the valid ones it
+// verifies.  The cache may be shared by many engines.
+func WithSigCache(sigCache *SigCache) ScriptOption {
+	return func(m *Script) {
+		m.sigCache = sigCache
+	}
+}
+
+// WithSigHashes returns an option that has the script engine compute signature
+// hashes from sigHashes, which must have been made for the same transaction
+// and previous outputs.  Engines for the inputs of one transaction should
+// share it, as otherwise each makes its own.
+func WithSigHashes(sigHashes *TxSigHashes) ScriptOption {
+	return func(m *Script) {
+		m.sigHashes = sigHashes
+	}
+}
+
 // NewScript returns a new script engine for the provided tx and input idx with
 // a signature script scriptSig and a pubkeyscript scriptPubKey. If bip16 is
 // true then it will be treated as if the bip16 threshhold has passed and thus
 // pay-to-script hash transactions will be fully validated.
-func NewScript(scriptSig []byte, scriptPubKey []byte, txidx int, tx *btcwire.MsgTx, flags ScriptFlags) (*Script, error) {
+func NewScript(scriptSig []byte, scriptPubKey []byte, txidx int, tx *btcwire.MsgTx, flags ScriptFlags, opts ...ScriptOption) (*Script, error) {
+	return NewScriptWithWitness(scriptSig, scriptPubKey, nil, nil, txidx,
+		tx, flags, opts...)
+}
+
+// NewScriptWithWitness returns a new script engine like NewScript that also
+// takes the witness of the input and prevOuts, the outputs spent by each of
+// the inputs of tx in order.  Witness signatures commit to the value of the
+// output being spent (bip143), and taproot signatures to the values and
+// pkScripts of all of them (bip341).  Both are only used when flags has
+// ScriptVerifyWitness set and scriptPubKey is a witness program, or a
+// pay-to-script-hash whose redeem script is one, in which case there must be
+// one previous output for every input.
+func NewScriptWithWitness(scriptSig []byte, scriptPubKey []byte, witness TxWitness, prevOuts []*btcwire.TxOut, txidx int, tx *btcwire.MsgTx, flags ScriptFlags, opts ...ScriptOption) (*Script, error) {
 	var m Script
 	scripts := [][]byte{scriptSig, scriptPubKey}
 	m.scripts = make([][]parsedOpcode, len(scripts))
 	for i, scr := range scripts {
+		if len(scr) > MaxScriptSize {
+			return nil, StackErrScriptTooBig
+		}
 		var err error
 		m.scripts[i], err = parseScript(scr)
 		if err != nil {
@@ -467,13 +773,54 @@ func NewScript(scriptSig []byte, scriptPubKey []byte, txidx int, tx *btcwire.Msg
 		}
 		m.bip16 = true
 	}
-	if flags&ScriptCanonicalSignatures == ScriptCanonicalSignatures {
+	if flags&ScriptVerifyWitness == ScriptVerifyWitness {
+		var program []byte
+		sigPops := m.scripts[0]
+		switch {
+		case isWitnessProgram(scriptPubKey):
+			if len(scriptSig) != 0 {
+				return nil, StackErrWitnessMalleated
+			}
+			program = scriptPubKey
+
+		case m.bip16 && len(sigPops) > 0 &&
+			isWitnessProgram(sigPops[len(sigPops)-1].data):
+			// A redeem script that is a witness program must be
+			// the only push of the sigScript, and a direct one,
+			// so that the sigScript can not be malleated.
+			program = sigPops[len(sigPops)-1].data
+			if len(scriptSig) != len(program)+1 {
+				return nil, StackErrWitnessMalleatedP2SH
+			}
+		}
+		if program != nil {
+			m.witnessVersion, m.witnessProgram =
+				extractWitnessProgram(program)
+			if !validPrevOuts(prevOuts, tx) {
+				return nil, StackErrInvalidPrevOuts
+			}
+			m.witness = witness
+			m.prevOuts = prevOuts
+		} else if len(witness) != 0 {
+			return nil, StackErrWitnessUnexpected
+		}
+	}
+	if flags&(ScriptCanonicalSignatures|ScriptVerifyLowS|
+		ScriptVerifyStrictEncoding) != 0 {
 		m.der = true
 	}
 
+	if txidx < 0 || txidx >= len(tx.TxIn) {
+		return nil, StackErrInvalidIndex
+	}
 	m.tx = *tx
 	m.txidx = txidx
 	m.condStack = []int{OpCondTrue}
+	m.flags = flags
+	m.dstack.verifyMinimalData = m.hasFlag(ScriptVerifyMinimalData)
+	for _, opt := range opts {
+		opt(&m)
+	}
 
 	return &m, nil
 }
@@ -515,8 +862,23 @@ func (s *Script) Execute() (err error) {
 
 // CheckErrorCondition returns nil if the running script has ended and was
 // successful, leaving a a true boolean on the stack. An error otherwise,
-// including if the script has not finished.
-func (s *Script) CheckErrorCondition() (err error) {
+// including if the script has not finished, as a *ScriptError.
+func (s *Script) CheckErrorCondition() error {
+	err := s.checkErrorCondition(true)
+	if err == nil {
+		return nil
+	}
+	if s.scriptidx < len(s.scripts) {
+		return s.newScriptError(err, s.scriptidx, s.scriptoff)
+	}
+	last := len(s.scripts) - 1
+	return s.newScriptError(err, last, len(s.scripts[last]))
+}
+
+// checkErrorCondition implements CheckErrorCondition.  finalScript is false
+// when checking the result of a pkScript that leads on to a redeem or
+// witness script, in which case the checks on the final stack are skipped.
+func (s *Script) checkErrorCondition(finalScript bool) (err error) {
 	// Check we are actually done. if pc is past the end of script array
 	// then we have run out of scripts to run.
 	if s.scriptidx < len(s.scripts) {
@@ -525,6 +887,11 @@ func (s *Script) CheckErrorCondition() (err error) {
 	if s.dstack.Depth() < 1 {
 		return StackErrEmptyStack
 	}
+
+	// Witness scripts must leave exactly one item on the stack.
+	if finalScript && s.witnessProgram != nil && s.dstack.Depth() != 1 {
+		return StackErrCleanStack
+	}
 	v, err := s.dstack.PopBool()
 	if err == nil && v == false {
 		// log interesting data.
@@ -536,6 +903,10 @@ func (s *Script) CheckErrorCondition() (err error) {
 		})
 		err = StackErrScriptFailed
 	}
+	if err == nil && finalScript && s.hasFlag(ScriptVerifyCleanStack) &&
+		s.dstack.Depth() != 0 {
+		err = StackErrCleanStack
+	}
 	if err == nil && len(s.condStack) != 1 {
 		// conditional execution stack context left active
 		err = StackErrMissingEndif
@@ -547,8 +918,31 @@ func (s *Script) CheckErrorCondition() (err error) {
 // next opcode in the script, or the next script if the curent has ended. Step
 // will return true in the case that the last opcode was successfully executed.
 // if an error is returned then the result of calling Step or any other method
-// is undefined.
+// is undefined.  Errors are returned as a *ScriptError.
 func (m *Script) Step() (done bool, err error) {
+	scriptIdx, offset := m.scriptidx, m.scriptoff
+	traced := m.tracer != nil && m.validPC() == nil
+	if traced {
+		m.tracer.BeforeStep(m.stepState(scriptIdx, offset))
+	}
+	done, err = m.step()
+	if err != nil {
+		// The program counter has moved on if the failure came
+		// after the script ended.
+		errOffset := offset
+		if m.scriptidx != scriptIdx || m.scriptoff != offset {
+			errOffset = len(m.scripts[scriptIdx])
+		}
+		err = m.newScriptError(err, scriptIdx, errOffset)
+	}
+	if traced {
+		m.tracer.AfterStep(m.stepState(scriptIdx, offset), err)
+	}
+	return done, err
+}
+
+// step implements Step, returning the errors that Step wraps.
+func (m *Script) step() (done bool, err error) {
 	// verify that it is pointing to a valid script address
 	err = m.validPC()
 	if err != nil {
@@ -556,6 +950,31 @@ func (m *Script) Step() (done bool, err error) {
 	}
 	opcode := m.scripts[m.scriptidx][m.scriptoff]
 
+	// The signature script is checked as a whole before it starts to run.
+	if m.scriptidx == 0 && m.scriptoff == 0 &&
+		m.hasFlag(ScriptVerifySigPushOnly) && !isPushOnly(m.scripts[0]) {
+		return false, StackErrNonPushOnly
+	}
+
+	// bitcoind rejects disabled opcodes and oversized pushes, and counts
+	// operations, whether or not the opcode is on the executing side of a
+	// conditional.  Note that OP_RESERVED is less than OP_16 and thus is
+	// counted as a push opcode here.
+	if opcode.disabled() {
+		return false, StackErrOpDisabled
+	}
+	if len(opcode.data) > MaxScriptElementSize {
+		return false, StackErrElementTooBig
+	}
+	// Tapscript has no limit on the number of operations, signature
+	// checks are limited by the size of the witness instead.
+	if opcode.opcode.value > OP_16 && !m.isWitnessVersionActive(1) {
+		m.numOps++
+		if m.numOps > MaxOpsPerScript {
+			return false, StackErrTooManyOperations
+		}
+	}
+
 	executeInstr := true
 	if m.condStack[0] != OpCondTrue {
 		// some opcodes still 'activate' if on the non-executing side
@@ -573,9 +992,22 @@ func (m *Script) Step() (done bool, err error) {
 		}
 	}
 
+	// The limit on the combined size of the stacks is checked after every
+	// opcode rather than on each push so that opcodes which temporarily
+	// grow the stack behave the same as in bitcoind.
+	if m.dstack.Depth()+m.astack.Depth() > MaxStackSize {
+		return false, StackErrStackOverflow
+	}
+
 	// prepare for next instruction
 	m.scriptoff++
 	if m.scriptoff >= len(m.scripts[m.scriptidx]) {
+		// bitcoind evaluates each script on its own, so a conditional
+		// may not be left open at the end of one and only the data
+		// stack carries over to the next.
+		if len(m.condStack) != 1 {
+			return false, StackErrMissingEndif
+		}
 		m.numOps = 0 // number of ops is per script.
 		m.scriptoff = 0
 		if m.scriptidx == 0 && m.bip16 {
@@ -586,12 +1018,15 @@ func (m *Script) Step() (done bool, err error) {
 			m.scriptidx++
 			// We check script ran ok, if so then we pull
 			// the script out of the first stack and executre that.
-			err := m.CheckErrorCondition()
+			err := m.checkErrorCondition(false)
 			if err != nil {
 				return false, err
 			}
 
 			script := m.savedFirstStack[len(m.savedFirstStack)-1]
+			if len(script) > MaxScriptSize {
+				return false, StackErrScriptTooBig
+			}
 			pops, err := parseScript(script)
 			if err != nil {
 				return false, err
@@ -600,6 +1035,22 @@ func (m *Script) Step() (done bool, err error) {
 			// Set stack to be the stack from first script
 			// minus the script itself
 			m.SetStack(m.savedFirstStack[:len(m.savedFirstStack)-1])
+		} else if m.witnessProgram != nil &&
+			(m.scriptidx == 1 || m.scriptidx == 2 && m.bip16) {
+			// The witness program is either the pkScript or, for
+			// a pay-to-script-hash output, the redeem script.
+			// Put us past the end for checkErrorCondition()
+			m.scriptidx++
+			err := m.checkErrorCondition(false)
+			if err != nil {
+				return false, err
+			}
+
+			// Run the witness script, if any, on the witness.
+			err = m.verifyWitnessProgram()
+			if err != nil {
+				return false, err
+			}
 		} else {
 			m.scriptidx++
 		}
@@ -610,11 +1061,19 @@ func (m *Script) Step() (done bool, err error) {
 		m.lastcodesep = 0
 		if m.scriptidx >= len(m.scripts) {
 			done = true
+		} else {
+			m.astack = Stack{}
 		}
 	}
 	return
 }
 
+// hasFlag returns whether the script engine was created with the passed flag
+// set.
+func (m *Script) hasFlag(flag ScriptFlags) bool {
+	return m.flags&flag == flag
+}
+
 // curPC returns either the current script and offset, or an error if the
 // position isn't valid.
 func (m *Script) curPC() (script int, off int, err error) {
@@ -664,8 +1123,14 @@ func (m *Script) DisasmPC() (disstr string, err error) {
 // provided position in the script. it does no error checking and leaves that
 // to the caller to provide a valid offse.
 func (m *Script) disasm(scriptidx int, scriptoff int) string {
+	return disasmOpcode(scriptidx, scriptoff, &m.scripts[scriptidx][scriptoff])
+}
+
+// disasmOpcode returns the disassembly of pop at offset scriptoff of the
+// script at scriptidx, as DisasmPC prints it.
+func disasmOpcode(scriptidx int, scriptoff int, pop *parsedOpcode) string {
 	return fmt.Sprintf("%02x:%04x: %s", scriptidx, scriptoff,
-		m.scripts[scriptidx][scriptoff].print(false))
+		pop.print(false))
 }
 
 // subScript will return the script since the last OP_CODESEPARATOR
@@ -722,86 +1187,7 @@ func DisasmString(buf []byte) (string, error) {
 // scriptmachine, calculate the doubleSha256 hash of the transaction and
 // script to be used for signature signing and verification.
 func calcScriptHash(script []parsedOpcode, hashType byte, tx *btcwire.MsgTx, idx int) []byte {
-
-	// remove all instances of OP_CODESEPARATOR still left in the script
-	script = removeOpcode(script, OP_CODESEPARATOR)
-
-	// Make a deep copy of the transaction, zeroing out the script
-	// for all inputs that are not currently being processed.
-	txCopy := tx.Copy()
-	for i := range txCopy.TxIn {
-		var txIn btcwire.TxIn
-		txIn = *txCopy.TxIn[i]
-		txCopy.TxIn[i] = &txIn
-		if i == idx {
-			// unparseScript cannot fail here, because removeOpcode
-			// above only returns a valid script.
-			sigscript, _ := unparseScript(script)
-			txCopy.TxIn[idx].SignatureScript = sigscript
-		} else {
-			txCopy.TxIn[i].SignatureScript = []byte{}
-		}
-	}
-	// Default behaviour has all outputs set up.
-	for i := range txCopy.TxOut {
-		var txOut btcwire.TxOut
-		txOut = *txCopy.TxOut[i]
-		txCopy.TxOut[i] = &txOut
-	}
-
-	switch hashType & 31 {
-	case SigHashNone:
-		txCopy.TxOut = txCopy.TxOut[0:0] // empty slice
-		for i := range txCopy.TxIn {
-			if i != idx {
-				txCopy.TxIn[i].Sequence = 0
-			}
-		}
-	case SigHashSingle:
-		if idx >= len(txCopy.TxOut) {
-			// This was created by a buggy implementation.
-			// In this case we do the same as bitcoind and bitcoinj
-			// and return 1 (as a uint256 little endian) as an
-			// error. Unfortunately this was not checked anywhere
-			// and thus is treated as the actual
-			// hash.
-			hash := make([]byte, 32)
-			hash[0] = 0x01
-			return hash
-		}
-		// Resize output array to up to and including requested index.
-		txCopy.TxOut = txCopy.TxOut[:idx+1]
-		// all but  current output get zeroed out
-		for i := 0; i < idx; i++ {
-			txCopy.TxOut[i].Value = -1
-			txCopy.TxOut[i].PkScript = []byte{}
-		}
-		// Sequence on all other inputs is 0, too.
-		for i := range txCopy.TxIn {
-			if i != idx {
-				txCopy.TxIn[i].Sequence = 0
-			}
-		}
-	default:
-		// XXX bitcoind treats undefined hashtypes like normal
-		// SigHashAll for purposes of hash generation.
-		fallthrough
-	case SigHashOld:
-		fallthrough
-	case SigHashAll:
-		// nothing special here
-	}
-	if hashType&SigHashAnyOneCanPay != 0 {
-		txCopy.TxIn = txCopy.TxIn[idx : idx+1]
-		idx = 0
-	}
-
-	var wbuf bytes.Buffer
-	txCopy.Serialize(&wbuf)
-	// Append LE 4 bytes hash type
-	binary.Write(&wbuf, binary.LittleEndian, uint32(hashType))
-
-	return btcwire.DoubleSha256(wbuf.Bytes())
+	return NewTxSigHashes(tx, nil).calcScriptHash(script, hashType, idx)
 }
 
 // scriptUInt8 return the number stored in the first byte of a slice.
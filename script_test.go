@@ -7,6 +7,7 @@ package btcscript_test
 import (
 	"bytes"
 	"crypto/ecdsa"
+	"errors"
 	"github.com/conformal/btcec"
 	"github.com/conformal/btcscript"
 	"github.com/conformal/btcutil"
@@ -1467,7 +1468,7 @@ func testTx(t *testing.T, test txTest) {
 		if test.shouldFail == true {
 			return
 		}
-		if err != test.err {
+		if !errors.Is(err, test.err) {
 			t.Errorf("Failed to validate %s tx: %v expected %v",
 				test.name, err, test.err)
 		}
@@ -1485,6 +1486,306 @@ func TestTX(t *testing.T) {
 	}
 }
 
+// highS returns the signature in the push sigPush, including its hashtype
+// byte, with S replaced by N-S.  The result verifies just like the original.
+func highS(t *testing.T, sigPush []byte) []byte {
+	sig, err := btcec.ParseSignature(sigPush[:len(sigPush)-1], btcec.S256())
+	if err != nil {
+		t.Fatalf("highS: %v", err)
+	}
+	s := new(big.Int).Sub(btcec.S256().N, sig.S)
+
+	// DER integers are big-endian and get a leading zero byte when the
+	// top bit would otherwise be set.
+	derInt := func(i *big.Int) []byte {
+		b := i.Bytes()
+		if b[0]&0x80 != 0 {
+			b = append([]byte{0}, b...)
+		}
+		return append([]byte{0x02, byte(len(b))}, b...)
+	}
+	body := append(derInt(sig.R), derInt(s)...)
+	der := append([]byte{0x30, byte(len(body))}, body...)
+	return append(der, sigPush[len(sigPush)-1])
+}
+
+func TestLowS(t *testing.T) {
+	var checkSig, checkMultiSig txTest
+	for _, test := range txTests {
+		switch test.name {
+		case "CheckSig":
+			checkSig = test
+		case "CheckMultiSig":
+			checkMultiSig = test
+		}
+	}
+
+	// The CheckSig signature has a low S, flip it to get a high one.
+	highSigTx := checkSig.tx.Copy()
+	sigScript := highSigTx.TxIn[checkSig.idx].SignatureScript
+	sig := highS(t, sigScript[1:])
+	highSigTx.TxIn[checkSig.idx].SignatureScript = append(
+		[]byte{byte(len(sig))}, sig...)
+
+	tests := []struct {
+		name     string
+		tx       *btcwire.MsgTx
+		idx      int
+		pkScript []byte
+		err      error
+	}{
+		{
+			name:     "checksig low S",
+			tx:       checkSig.tx,
+			idx:      checkSig.idx,
+			pkScript: checkSig.pkScript,
+		},
+		{
+			name:     "checksig high S",
+			tx:       highSigTx,
+			idx:      checkSig.idx,
+			pkScript: checkSig.pkScript,
+			err:      btcscript.StackErrHighS,
+		},
+		{
+			// The CheckMultiSig signature was mined with a high S.
+			name:     "checkmultisig high S",
+			tx:       checkMultiSig.tx,
+			idx:      checkMultiSig.idx,
+			pkScript: checkMultiSig.pkScript,
+			err:      btcscript.StackErrHighS,
+		},
+	}
+
+	for _, test := range tests {
+		// Without the flag every signature is fine.
+		for _, flags := range []btcscript.ScriptFlags{0,
+			btcscript.ScriptVerifyLowS} {
+			engine, err := btcscript.NewScript(
+				test.tx.TxIn[test.idx].SignatureScript,
+				test.pkScript, test.idx, test.tx, flags)
+			if err != nil {
+				t.Errorf("%s: failed to parse: %v", test.name, err)
+				continue
+			}
+			want := test.err
+			if flags == 0 {
+				want = nil
+			}
+			err = engine.Execute()
+			if !errors.Is(err, want) {
+				t.Errorf("%s (flags %d): got %v, want %v",
+					test.name, flags, err, want)
+			}
+		}
+	}
+}
+
+func TestStrictEncoding(t *testing.T) {
+	var checkSig, checkMultiSig txTest
+	for _, test := range txTests {
+		switch test.name {
+		case "CheckSig":
+			checkSig = test
+		case "CheckMultiSig":
+			checkMultiSig = test
+		}
+	}
+
+	// Hybrid encoding of the CheckSig pubkey: the uncompressed key with
+	// the parity of Y folded into the prefix byte.  Since the pkScript is
+	// signed the signature no longer matches, but strict encoding must
+	// fail before getting that far.
+	hybridPkScript := make([]byte, len(checkSig.pkScript))
+	copy(hybridPkScript, checkSig.pkScript)
+	hybridPkScript[1] = 0x06 | hybridPkScript[65]&0x01
+
+	// Undefined hashtype on the CheckSig signature.
+	badHashTypeTx := checkSig.tx.Copy()
+	sigScript := badHashTypeTx.TxIn[checkSig.idx].SignatureScript
+	sigScript = append([]byte{}, sigScript...)
+	sigScript[len(sigScript)-1] = 0x04
+	badHashTypeTx.TxIn[checkSig.idx].SignatureScript = sigScript
+
+	// Undefined hashtype on the CheckMultiSig signature, which is the
+	// last byte of the push following the dummy OP_FALSE.
+	badMultiHashTypeTx := checkMultiSig.tx.Copy()
+	sigScript = badMultiHashTypeTx.TxIn[checkMultiSig.idx].SignatureScript
+	sigScript = append([]byte{}, sigScript...)
+	sigScript[1+sigScript[1]] = 0x84
+	badMultiHashTypeTx.TxIn[checkMultiSig.idx].SignatureScript = sigScript
+
+	// Multisig with empty signatures against the CheckSig pubkey and its
+	// hybrid encoding.  The hybrid key is only checked when the empty
+	// signature is tried against it, which it no longer is once there are
+	// too few keys left for the remaining signatures.
+	emptySigsTx := checkSig.tx.Copy()
+	emptySigsTx.TxIn[checkSig.idx].SignatureScript = []byte{
+		btcscript.OP_0, btcscript.OP_0, btcscript.OP_0}
+	pubKey := checkSig.pkScript[1:66]
+	hybridPubKey := hybridPkScript[1:66]
+	// A single empty signature against the hybrid key, with the failed
+	// check negated so that only the encoding of the key can fail it.
+	emptySigTx := checkSig.tx.Copy()
+	emptySigTx.TxIn[checkSig.idx].SignatureScript = []byte{btcscript.OP_0}
+	hybridNotPkScript := append(append([]byte{}, hybridPkScript...),
+		btcscript.OP_NOT)
+
+	// Multisig with a signature with an undefined hashtype that is never
+	// tried, since the empty signature above it, which is tried first,
+	// leaves too few keys.
+	untriedSigTx := checkSig.tx.Copy()
+	untriedSigTx.TxIn[checkSig.idx].SignatureScript = []byte{
+		btcscript.OP_0, btcscript.OP_DATA_1, 0x84, btcscript.OP_0}
+
+	multiSigScript := func(nsigs byte, pubKeys ...[]byte) []byte {
+		script := []byte{nsigs}
+		for _, pubKey := range pubKeys {
+			script = append(script, btcscript.OP_DATA_65)
+			script = append(script, pubKey...)
+		}
+		return append(script, btcscript.OP_1-1+byte(len(pubKeys)),
+			btcscript.OP_CHECKMULTISIG)
+	}
+
+	tests := []struct {
+		name      string
+		tx        *btcwire.MsgTx
+		idx       int
+		pkScript  []byte
+		err       error // with ScriptVerifyStrictEncoding
+		nonStrict error // without
+	}{
+		{
+			name:     "checksig",
+			tx:       checkSig.tx,
+			idx:      checkSig.idx,
+			pkScript: checkSig.pkScript,
+		},
+		{
+			name:      "hybrid pubkey",
+			tx:        checkSig.tx,
+			idx:       checkSig.idx,
+			pkScript:  hybridPkScript,
+			err:       btcscript.StackErrPubKeyType,
+			nonStrict: btcscript.StackErrScriptFailed,
+		},
+		{
+			name:      "undefined hashtype",
+			tx:        badHashTypeTx,
+			idx:       checkSig.idx,
+			pkScript:  checkSig.pkScript,
+			err:       btcscript.StackErrInvalidSigHashType,
+			nonStrict: btcscript.StackErrScriptFailed,
+		},
+		{
+			name:      "multisig undefined hashtype",
+			tx:        badMultiHashTypeTx,
+			idx:       checkMultiSig.idx,
+			pkScript:  checkMultiSig.pkScript,
+			err:       btcscript.StackErrInvalidSigHashType,
+			nonStrict: btcscript.StackErrScriptFailed,
+		},
+		{
+			name: "multisig empty signature hybrid pubkey",
+			tx:   emptySigsTx,
+			idx:  checkSig.idx,
+			pkScript: multiSigScript(btcscript.OP_1, pubKey,
+				hybridPubKey),
+			err:       btcscript.StackErrPubKeyType,
+			nonStrict: btcscript.StackErrScriptFailed,
+		},
+		{
+			name:     "empty signature hybrid pubkey",
+			tx:       emptySigTx,
+			idx:      checkSig.idx,
+			pkScript: hybridNotPkScript,
+			err:      btcscript.StackErrPubKeyType,
+		},
+		{
+			name: "multisig untried undefined hashtype",
+			tx:   untriedSigTx,
+			idx:  checkSig.idx,
+			pkScript: multiSigScript(btcscript.OP_2, pubKey,
+				pubKey),
+			err:       btcscript.StackErrScriptFailed,
+			nonStrict: btcscript.StackErrScriptFailed,
+		},
+		{
+			name: "multisig more signatures than pubkeys",
+			tx:   emptySigsTx,
+			idx:  checkSig.idx,
+			pkScript: append(multiSigScript(btcscript.OP_2, pubKey),
+				btcscript.OP_NOT),
+			err:       btcscript.StackErrInvalidArgs,
+			nonStrict: btcscript.StackErrInvalidArgs,
+		},
+		{
+			name: "multisig empty signatures untried hybrid pubkey",
+			tx:   emptySigsTx,
+			idx:  checkSig.idx,
+			pkScript: multiSigScript(btcscript.OP_2, hybridPubKey,
+				pubKey),
+			err:       btcscript.StackErrScriptFailed,
+			nonStrict: btcscript.StackErrScriptFailed,
+		},
+	}
+
+	for _, test := range tests {
+		for _, flags := range []btcscript.ScriptFlags{0,
+			btcscript.ScriptVerifyStrictEncoding} {
+			engine, err := btcscript.NewScript(
+				test.tx.TxIn[test.idx].SignatureScript,
+				test.pkScript, test.idx, test.tx, flags)
+			if err != nil {
+				t.Errorf("%s: failed to parse: %v", test.name, err)
+				continue
+			}
+			want := test.err
+			if flags == 0 {
+				want = test.nonStrict
+			}
+			err = engine.Execute()
+			if !errors.Is(err, want) {
+				t.Errorf("%s (flags %d): got %v, want %v",
+					test.name, flags, err, want)
+			}
+		}
+	}
+}
+
+func TestNullFail(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error // with ScriptVerifyNullFail
+	}{
+		{name: "CheckSig"},
+		{name: "CheckSig Failure", err: btcscript.StackErrNullFail},
+		{name: "CheckMultiSig"},
+		{name: "CheckMultiSig fail", err: btcscript.StackErrNullFail},
+	}
+
+	for _, test := range tests {
+		var txt txTest
+		for _, txt = range txTests {
+			if txt.name == test.name {
+				break
+			}
+		}
+		engine, err := btcscript.NewScript(
+			txt.tx.TxIn[txt.idx].SignatureScript, txt.pkScript,
+			txt.idx, txt.tx, btcscript.ScriptVerifyNullFail)
+		if err != nil {
+			t.Errorf("%s: failed to parse: %v", test.name, err)
+			continue
+		}
+		err = engine.Execute()
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
 func TestGetPreciseSignOps(t *testing.T) {
 	// First we go over the range of tests in testTx and count the sigops in
 	// them.
@@ -2321,7 +2622,7 @@ func TestCheckErrorCondition(t *testing.T) {
 		}
 
 		err = engine.CheckErrorCondition()
-		if err != btcscript.StackErrScriptUnfinished {
+		if !errors.Is(err, btcscript.StackErrScriptUnfinished) {
 			t.Errorf("got unexepected error %v on %dth iteration",
 				err, i)
 			return
@@ -2343,6 +2644,135 @@ func TestCheckErrorCondition(t *testing.T) {
 	}
 }
 
+// TestScriptBoundaries ensures that conditionals and the alt stack do not
+// carry over from one script to the next.
+func TestScriptBoundaries(t *testing.T) {
+	tests := []struct {
+		name      string
+		sigScript []byte
+		pkScript  []byte
+		flags     btcscript.ScriptFlags
+		err       error
+	}{
+		{
+			name:      "if spanning scripts",
+			sigScript: []byte{btcscript.OP_1, btcscript.OP_IF},
+			pkScript:  []byte{btcscript.OP_1, btcscript.OP_ENDIF},
+			err:       btcscript.StackErrMissingEndif,
+		},
+		{
+			name:      "endif without if in pkscript",
+			sigScript: []byte{btcscript.OP_0, btcscript.OP_IF},
+			pkScript:  []byte{btcscript.OP_ENDIF, btcscript.OP_1},
+			err:       btcscript.StackErrMissingEndif,
+		},
+		{
+			name: "alt stack across scripts",
+			sigScript: []byte{btcscript.OP_1,
+				btcscript.OP_TOALTSTACK},
+			pkScript: []byte{btcscript.OP_FROMALTSTACK},
+			err:      btcscript.StackErrUnderflow,
+		},
+		{
+			name:      "alt stack within a script",
+			sigScript: []byte{btcscript.OP_1},
+			pkScript: []byte{btcscript.OP_TOALTSTACK,
+				btcscript.OP_FROMALTSTACK},
+		},
+		{
+			name:      "data stack across scripts",
+			sigScript: []byte{btcscript.OP_1},
+			pkScript:  []byte{btcscript.OP_NOP},
+		},
+		{
+			name:      "non push only sigscript",
+			sigScript: []byte{btcscript.OP_1, btcscript.OP_DUP},
+			pkScript:  []byte{btcscript.OP_EQUAL},
+		},
+		{
+			name:      "non push only sigscript with sigpushonly",
+			sigScript: []byte{btcscript.OP_1, btcscript.OP_DUP},
+			pkScript:  []byte{btcscript.OP_EQUAL},
+			flags:     btcscript.ScriptVerifySigPushOnly,
+			err:       btcscript.StackErrNonPushOnly,
+		},
+		{
+			name:      "push only sigscript with sigpushonly",
+			sigScript: []byte{btcscript.OP_1, btcscript.OP_1},
+			pkScript:  []byte{btcscript.OP_EQUAL},
+			flags:     btcscript.ScriptVerifySigPushOnly,
+		},
+		{
+			name:      "unclean stack",
+			sigScript: []byte{btcscript.OP_1, btcscript.OP_1},
+			pkScript:  []byte{btcscript.OP_NOP},
+		},
+		{
+			name:      "unclean stack with cleanstack",
+			sigScript: []byte{btcscript.OP_1, btcscript.OP_1},
+			pkScript:  []byte{btcscript.OP_NOP},
+			flags:     btcscript.ScriptVerifyCleanStack,
+			err:       btcscript.StackErrCleanStack,
+		},
+		{
+			name:      "clean stack with cleanstack",
+			sigScript: []byte{btcscript.OP_1},
+			pkScript:  []byte{btcscript.OP_NOP},
+			flags:     btcscript.ScriptVerifyCleanStack,
+		},
+		{
+			// The pkScript result is consumed before the redeem
+			// script runs and must not count against the stack.
+			name: "p2sh clean stack with cleanstack",
+			sigScript: []byte{btcscript.OP_DATA_1,
+				btcscript.OP_1},
+			pkScript: []byte{btcscript.OP_HASH160,
+				btcscript.OP_DATA_20,
+				0xda, 0x17, 0x45, 0xe9, 0xb5, 0x49, 0xbd, 0x0b,
+				0xfa, 0x1a, 0x56, 0x99, 0x71, 0xc7, 0x7e, 0xba,
+				0x30, 0xcd, 0x5a, 0x4b, btcscript.OP_EQUAL},
+			flags: btcscript.ScriptBip16 |
+				btcscript.ScriptVerifyCleanStack,
+		},
+	}
+
+	tx := &btcwire.MsgTx{
+		Version: 1,
+		TxIn: []*btcwire.TxIn{
+			&btcwire.TxIn{
+				PreviousOutpoint: btcwire.OutPoint{
+					Hash:  btcwire.ShaHash{},
+					Index: 0,
+				},
+				SignatureScript: []byte{},
+				Sequence:        4294967295,
+			},
+		},
+		TxOut: []*btcwire.TxOut{
+			&btcwire.TxOut{
+				Value:    1000000000,
+				PkScript: []byte{},
+			},
+		},
+		LockTime: 0,
+	}
+
+	for _, test := range tests {
+		engine, err := btcscript.NewScript(test.sigScript,
+			test.pkScript, 0, tx, test.flags)
+		if err != nil {
+			t.Errorf("%s: failed to create script: %v", test.name,
+				err)
+			continue
+		}
+		err = engine.Execute()
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got error [%v], expected [%v]", test.name,
+				err, test.err)
+		}
+	}
+}
+
 func TestPayToPubKeyHashScript(t *testing.T) {
 	validaddr := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
 		16, 17, 18, 19, 20}
@@ -2736,6 +3166,98 @@ nexttest:
 	}
 }
 
+// TestCheckMultiSigKeyOrder tests that each pubkey of a multisig script
+// satisfies at most one of its signatures.
+func TestCheckMultiSigKeyOrder(t *testing.T) {
+	privkey := &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: btcec.S256(),
+			X:     new(big.Int),
+			Y:     new(big.Int),
+		},
+		D: new(big.Int),
+	}
+	privkey.D.SetBytes(privkeyD)
+	privkey.PublicKey.X.SetBytes(pubkeyX)
+	privkey.PublicKey.Y.SetBytes(pubkeyY)
+	pubKey := append(append([]byte{0x04}, pubkeyX...), pubkeyY...)
+
+	// Any other valid key will do, it is never signed with.
+	var otherPubKey []byte
+	for _, test := range txTests {
+		if test.name == "CheckSig" {
+			otherPubKey = test.pkScript[1:66]
+		}
+	}
+
+	tests := []struct {
+		name    string
+		nsigs   byte
+		pubKeys [][]byte
+		sigs    int
+		err     error
+	}{
+		{
+			name:    "1-of-2",
+			nsigs:   btcscript.OP_1,
+			pubKeys: [][]byte{otherPubKey, pubKey},
+			sigs:    1,
+		},
+		{
+			name:    "2-of-2 signed twice by one key",
+			nsigs:   btcscript.OP_2,
+			pubKeys: [][]byte{otherPubKey, pubKey},
+			sigs:    2,
+			err:     btcscript.StackErrScriptFailed,
+		},
+		{
+			name:    "2-of-2 with the key twice",
+			nsigs:   btcscript.OP_2,
+			pubKeys: [][]byte{pubKey, pubKey},
+			sigs:    2,
+		},
+	}
+
+	for _, test := range tests {
+		pkScript := []byte{test.nsigs}
+		for _, key := range test.pubKeys {
+			pkScript = append(pkScript, btcscript.OP_DATA_65)
+			pkScript = append(pkScript, key...)
+		}
+		pkScript = append(pkScript,
+			btcscript.OP_1-1+byte(len(test.pubKeys)),
+			btcscript.OP_CHECKMULTISIG)
+
+		tx := btcwire.NewMsgTx()
+		tx.AddTxIn(btcwire.NewTxIn(coinbaseOutPoint, nil))
+		tx.AddTxOut(btcwire.NewTxOut(500, []byte{btcscript.OP_RETURN}))
+
+		// The signature is the first push of the signature script.
+		script, err := btcscript.SignatureScript(tx, 0, pkScript,
+			btcscript.SigHashAll, privkey, false)
+		if err != nil {
+			t.Errorf("%s: failed to sign: %v", test.name, err)
+			continue
+		}
+		sig := script[:1+script[0]]
+		sigScript := []byte{btcscript.OP_0}
+		for i := 0; i < test.sigs; i++ {
+			sigScript = append(sigScript, sig...)
+		}
+		tx.TxIn[0].SignatureScript = sigScript
+
+		engine, err := btcscript.NewScript(sigScript, pkScript, 0, tx, 0)
+		if err != nil {
+			t.Errorf("%s: failed to parse: %v", test.name, err)
+			continue
+		}
+		err = engine.Execute()
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
 var classStringifyTests = []struct {
 	name        string
 	scriptclass btcscript.ScriptClass
@@ -0,0 +1,123 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcscript
+
+const (
+	maxInt32 = 1<<31 - 1
+	minInt32 = -1 << 31
+
+	// defaultScriptNumLen is the default number of bytes data being
+	// interpreted as a number may be.
+	defaultScriptNumLen = 4
+)
+
+// ScriptNum represents a numeric value used by the script engine.
+//
+// Numbers are stored on the stacks as little endian byte arrays with the sign
+// in the high bit of the most significant byte.  The numeric opcodes only
+// accept operands of up to 4 bytes, which gives a range of [-2^31+1, 2^31-1],
+// but their results may overflow that range.  Such results remain valid on the
+// stack as long as they are not used as the operand of another numeric opcode.
+// Storing the value as an int64 covers every result that can be produced from
+// 4-byte operands, and operands of up to 8 bytes where a caller asks for them.
+type ScriptNum int64
+
+// checkMinimalDataEncoding returns whether or not the passed byte array
+// adheres to the minimal encoding requirements.
+func checkMinimalDataEncoding(v []byte) error {
+	if len(v) == 0 {
+		return nil
+	}
+
+	// The most significant byte, ignoring the sign bit, may only be zero
+	// when the byte below it has its high bit set, since that bit would
+	// otherwise be taken for the sign.  This also rejects negative zero.
+	if v[len(v)-1]&0x7f == 0 {
+		if len(v) == 1 || v[len(v)-2]&0x80 == 0 {
+			return StackErrMinimalData
+		}
+	}
+	return nil
+}
+
+// Bytes returns the number serialized as a little endian byte array with the
+// sign in the high bit of the most significant byte.  Zero serializes to an
+// empty array.
+func (n ScriptNum) Bytes() []byte {
+	if n == 0 {
+		return nil
+	}
+
+	isNegative := n < 0
+	if isNegative {
+		n = -n
+	}
+
+	result := make([]byte, 0, 9)
+	for n > 0 {
+		result = append(result, byte(n&0xff))
+		n >>= 8
+	}
+
+	// An extra byte is needed when the high bit of the most significant
+	// byte is already used by the value, otherwise the sign goes there.
+	if result[len(result)-1]&0x80 != 0 {
+		extraByte := byte(0x00)
+		if isNegative {
+			extraByte = 0x80
+		}
+		result = append(result, extraByte)
+	} else if isNegative {
+		result[len(result)-1] |= 0x80
+	}
+
+	return result
+}
+
+// Int32 returns the number clamped to a valid int32.  Values out of range are
+// clamped to the closest limit rather than truncated, which matches what the
+// reference implementation does for opcodes that need an int.
+func (n ScriptNum) Int32() int32 {
+	if n > maxInt32 {
+		return maxInt32
+	}
+	if n < minInt32 {
+		return minInt32
+	}
+	return int32(n)
+}
+
+// makeScriptNum interprets the passed byte array as a number.  Arrays longer
+// than scriptNumLen are rejected with StackErrNumberTooBig, and when
+// requireMinimal is set arrays which are not minimally encoded are rejected
+// with StackErrMinimalData.  scriptNumLen must not be more than 8.
+func makeScriptNum(v []byte, requireMinimal bool, scriptNumLen int) (ScriptNum, error) {
+	if len(v) > scriptNumLen {
+		return 0, StackErrNumberTooBig
+	}
+
+	if requireMinimal {
+		if err := checkMinimalDataEncoding(v); err != nil {
+			return 0, err
+		}
+	}
+
+	if len(v) == 0 {
+		return 0, nil
+	}
+
+	var result int64
+	for i, val := range v {
+		result |= int64(val) << uint8(8*i)
+	}
+
+	// Clear the sign bit and negate when it was set.
+	if v[len(v)-1]&0x80 != 0 {
+		result &= ^(int64(0x80) << uint8(8*(len(v)-1)))
+		return ScriptNum(-result), nil
+	}
+
+	return ScriptNum(result), nil
+}
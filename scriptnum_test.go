@@ -0,0 +1,159 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcscript_test
+
+import (
+	"bytes"
+	"github.com/conformal/btcscript"
+	"testing"
+)
+
+// TestScriptNumBytes ensures that converting from integral script numbers to
+// byte representations works as expected.
+func TestScriptNumBytes(t *testing.T) {
+	tests := []struct {
+		num        btcscript.ScriptNum
+		serialized []byte
+	}{
+		{0, nil},
+		{1, decodeHex("01")},
+		{-1, decodeHex("81")},
+		{127, decodeHex("7f")},
+		{-127, decodeHex("ff")},
+		{128, decodeHex("8000")},
+		{-128, decodeHex("8080")},
+		{129, decodeHex("8100")},
+		{-129, decodeHex("8180")},
+		{256, decodeHex("0001")},
+		{-256, decodeHex("0081")},
+		{32767, decodeHex("ff7f")},
+		{-32767, decodeHex("ffff")},
+		{32768, decodeHex("008000")},
+		{-32768, decodeHex("008080")},
+		{65535, decodeHex("ffff00")},
+		{-65535, decodeHex("ffff80")},
+		{2147483647, decodeHex("ffffff7f")},
+		{-2147483647, decodeHex("ffffffff")},
+		{2147483648, decodeHex("0000008000")},
+		{-2147483648, decodeHex("0000008080")},
+		{4294967295, decodeHex("ffffffff00")},
+		{-4294967295, decodeHex("ffffffff80")},
+		{549755813887, decodeHex("ffffffff7f")},
+		{-549755813887, decodeHex("ffffffffff")},
+		{9223372036854775807, decodeHex("ffffffffffffff7f")},
+		{-9223372036854775807, decodeHex("ffffffffffffffff")},
+	}
+
+	for _, test := range tests {
+		gotBytes := test.num.Bytes()
+		if !bytes.Equal(gotBytes, test.serialized) {
+			t.Errorf("Bytes: did not get expected bytes for %d - "+
+				"got %x, want %x", test.num, gotBytes,
+				test.serialized)
+			continue
+		}
+	}
+}
+
+// TestMakeScriptNum ensures that converting from byte representations to
+// integral script numbers works as expected.
+func TestMakeScriptNum(t *testing.T) {
+	tests := []struct {
+		serialized      []byte
+		num             btcscript.ScriptNum
+		numLen          int
+		minimalEncoding bool
+		err             error
+	}{
+		// Minimal encoding must reject negative 0.
+		{decodeHex("80"), 0, 4, true, btcscript.StackErrMinimalData},
+
+		// Minimally encoded valid values with minimal encoding flag.
+		{nil, 0, 4, true, nil},
+		{decodeHex("01"), 1, 4, true, nil},
+		{decodeHex("81"), -1, 4, true, nil},
+		{decodeHex("7f"), 127, 4, true, nil},
+		{decodeHex("ff"), -127, 4, true, nil},
+		{decodeHex("8000"), 128, 4, true, nil},
+		{decodeHex("8080"), -128, 4, true, nil},
+		{decodeHex("0001"), 256, 4, true, nil},
+		{decodeHex("0081"), -256, 4, true, nil},
+		{decodeHex("ffffff7f"), 2147483647, 4, true, nil},
+		{decodeHex("ffffffff"), -2147483647, 4, true, nil},
+		{decodeHex("ffffffff7f"), 549755813887, 5, true, nil},
+		{decodeHex("ffffffffff"), -549755813887, 5, true, nil},
+
+		// Minimally encoded values that are out of range for data
+		// that is interpreted as script numbers.
+		{decodeHex("0000008000"), 0, 4, true, btcscript.StackErrNumberTooBig},
+		{decodeHex("0000008080"), 0, 4, true, btcscript.StackErrNumberTooBig},
+		{decodeHex("ffffffff00"), 0, 4, true, btcscript.StackErrNumberTooBig},
+
+		// Non-minimally encoded, but otherwise valid values with
+		// minimal encoding flag.
+		{decodeHex("00"), 0, 4, true, btcscript.StackErrMinimalData},
+		{decodeHex("0100"), 0, 4, true, btcscript.StackErrMinimalData},
+		{decodeHex("7f00"), 0, 4, true, btcscript.StackErrMinimalData},
+		{decodeHex("800000"), 0, 4, true, btcscript.StackErrMinimalData},
+		{decodeHex("00000080"), 0, 4, true, btcscript.StackErrMinimalData},
+
+		// Non-minimally encoded, but otherwise valid values without
+		// minimal encoding flag.
+		{decodeHex("00"), 0, 4, false, nil},
+		{decodeHex("80"), 0, 4, false, nil},
+		{decodeHex("0100"), 1, 4, false, nil},
+		{decodeHex("7f00"), 127, 4, false, nil},
+		{decodeHex("800000"), 128, 4, false, nil},
+		{decodeHex("00000080"), 0, 4, false, nil},
+		{decodeHex("01000080"), -1, 4, false, nil},
+	}
+
+	for _, test := range tests {
+		gotNum, err := btcscript.TstMakeScriptNum(test.serialized,
+			test.minimalEncoding, test.numLen)
+		if err != test.err {
+			t.Errorf("makeScriptNum: did not receive expected "+
+				"error for %x - got %v, want %v",
+				test.serialized, err, test.err)
+			continue
+		}
+
+		if gotNum != test.num {
+			t.Errorf("makeScriptNum: did not get expected number "+
+				"for %x - got %d, want %d", test.serialized,
+				gotNum, test.num)
+			continue
+		}
+	}
+}
+
+// TestScriptNumInt32 ensures that the Int32 function on script numbers clamps
+// values out of the range of an int32.
+func TestScriptNumInt32(t *testing.T) {
+	tests := []struct {
+		in   btcscript.ScriptNum
+		want int32
+	}{
+		{0, 0},
+		{1, 1},
+		{-1, -1},
+		{2147483647, 2147483647},
+		{-2147483647, -2147483647},
+		{-2147483648, -2147483648},
+		{2147483648, 2147483647},
+		{-2147483649, -2147483648},
+		{9223372036854775807, 2147483647},
+		{-9223372036854775808, -2147483648},
+	}
+
+	for _, test := range tests {
+		got := test.in.Int32()
+		if got != test.want {
+			t.Errorf("Int32: did not get expected value for %d - "+
+				"got %d, want %d", test.in, got, test.want)
+			continue
+		}
+	}
+}
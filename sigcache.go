@@ -0,0 +1,71 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcscript
+
+import (
+	"sync"
+)
+
+// SigCache is a cache of valid ecdsa signatures, so that a signature seen
+// once, such as when a transaction is accepted to the mempool, need not be
+// verified again when the transaction shows up in a block.  Only valid
+// signatures are added, and once the cache is full a random entry is evicted
+// for each new one.  It is safe for concurrent use by many script engines.
+type SigCache struct {
+	sync.RWMutex
+	validSigs  map[string]struct{}
+	maxEntries int
+}
+
+// NewSigCache returns a signature cache that holds at most maxEntries
+// signatures.
+func NewSigCache(maxEntries int) *SigCache {
+	return &SigCache{
+		validSigs:  make(map[string]struct{}, maxEntries),
+		maxEntries: maxEntries,
+	}
+}
+
+// sigCacheKey returns the key of the signature sig of sigHash by pubKey.  The
+// length of sig is included so that keys of different signatures and public
+// keys can not run together.
+func sigCacheKey(sigHash, sig, pubKey []byte) string {
+	key := make([]byte, 0, len(sigHash)+1+len(sig)+len(pubKey))
+	key = append(key, sigHash...)
+	key = append(key, byte(len(sig)))
+	key = append(key, sig...)
+	key = append(key, pubKey...)
+	return string(key)
+}
+
+// Exists returns whether the signature sig of sigHash by the serialized public
+// key pubKey has been added to the cache.
+func (c *SigCache) Exists(sigHash, sig, pubKey []byte) bool {
+	c.RLock()
+	_, ok := c.validSigs[sigCacheKey(sigHash, sig, pubKey)]
+	c.RUnlock()
+	return ok
+}
+
+// Add adds the signature sig of sigHash by the serialized public key pubKey,
+// which must have been verified, to the cache.
+func (c *SigCache) Add(sigHash, sig, pubKey []byte) {
+	if c.maxEntries <= 0 {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	// Map iteration order is randomised, so the first key is a random
+	// entry to evict.
+	if len(c.validSigs) >= c.maxEntries {
+		for key := range c.validSigs {
+			delete(c.validSigs, key)
+			break
+		}
+	}
+	c.validSigs[sigCacheKey(sigHash, sig, pubKey)] = struct{}{}
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcscript_test
+
+import (
+	"bytes"
+	"errors"
+	"github.com/conformal/btcscript"
+	"github.com/conformal/btcwire"
+	"testing"
+)
+
+func TestSigCache(t *testing.T) {
+	cache := btcscript.NewSigCache(10)
+	hash := bytes.Repeat([]byte{0x01}, 32)
+	sig := []byte{0x02, 0x03}
+	pubKey := []byte{0x04}
+
+	if cache.Exists(hash, sig, pubKey) {
+		t.Errorf("empty cache has an entry")
+	}
+	cache.Add(hash, sig, pubKey)
+	if !cache.Exists(hash, sig, pubKey) {
+		t.Errorf("added entry not found")
+	}
+
+	// The same bytes split differently between the signature and the
+	// public key are another entry.
+	if cache.Exists(hash, sig[:1], append(sig[1:], pubKey...)) {
+		t.Errorf("entry found for another signature")
+	}
+
+	// The cache never holds more than its maximum number of entries.
+	for i := 0; i < 100; i++ {
+		cache.Add(hash, []byte{byte(i)}, pubKey)
+	}
+	found := 0
+	for i := 0; i < 100; i++ {
+		if cache.Exists(hash, []byte{byte(i)}, pubKey) {
+			found++
+		}
+	}
+	if found > 10 {
+		t.Errorf("cache holds %d entries, want at most 10", found)
+	}
+
+	empty := btcscript.NewSigCache(0)
+	empty.Add(hash, sig, pubKey)
+	if empty.Exists(hash, sig, pubKey) {
+		t.Errorf("entry found in cache without room")
+	}
+}
+
+// TestSigCacheScript checks that script engines add the signatures they verify
+// to their cache, and trust those they find in it.
+func TestSigCacheScript(t *testing.T) {
+	tx, pkScript, witness := p2wpkhSpend(t)
+	prevOuts := []*btcwire.TxOut{
+		btcwire.NewTxOut(0, nil),
+		btcwire.NewTxOut(600000000, pkScript),
+	}
+	flags := btcscript.ScriptBip16 | btcscript.ScriptVerifyWitness
+	execute := func(witness btcscript.TxWitness, opts ...btcscript.ScriptOption) error {
+		engine, err := btcscript.NewScriptWithWitness(nil, pkScript,
+			witness, prevOuts, 1, tx, flags, opts...)
+		if err != nil {
+			return err
+		}
+		return engine.Execute()
+	}
+
+	scriptCode, err := btcscript.PayToPubKeyHashScript(pkScript[2:])
+	if err != nil {
+		t.Fatalf("PayToPubKeyHashScript: %v", err)
+	}
+	hash, err := btcscript.CalcWitnessSignatureHash(scriptCode,
+		btcscript.SigHashAll, tx, 1, 600000000)
+	if err != nil {
+		t.Fatalf("CalcWitnessSignatureHash: %v", err)
+	}
+	sig := witness[0][:len(witness[0])-1]
+	pubKey := witness[1]
+
+	cache := btcscript.NewSigCache(10)
+	if err := execute(witness, btcscript.WithSigCache(cache)); err != nil {
+		t.Fatalf("valid signature: %v", err)
+	}
+	if !cache.Exists(hash, sig, pubKey) {
+		t.Errorf("valid signature not added to the cache")
+	}
+
+	// A signature that is wrong but well formed fails unless it is in the
+	// cache, which is only ever the case if it had been verified.
+	badSig := append([]byte{}, witness[0]...)
+	badSig[10] ^= 0x01
+	badWitness := btcscript.TxWitness{badSig, pubKey}
+	err = execute(badWitness)
+	if !errors.Is(err, btcscript.StackErrScriptFailed) {
+		t.Errorf("bad signature: got error [%v], expected [%v]", err,
+			btcscript.StackErrScriptFailed)
+	}
+	cache.Add(hash, badSig[:len(badSig)-1], pubKey)
+	if err := execute(badWitness, btcscript.WithSigCache(cache)); err != nil {
+		t.Errorf("cached bad signature: %v", err)
+	}
+}
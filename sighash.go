@@ -0,0 +1,208 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcscript
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/conformal/btcwire"
+	"github.com/conformal/fastsha256"
+	"io"
+)
+
+// blankTxInSize is the serialized size of an input with an empty signature
+// script: the outpoint, a zero script length and the sequence number.
+const blankTxInSize = 32 + 4 + 1 + 4
+
+// TxSigHashes holds the parts of a transaction that the signature hashes of
+// all of its inputs are computed from, serialized or hashed once, so that
+// checking the signatures of every input does not copy and serialize the
+// whole transaction for each of them.  The transaction must not be modified
+// once a TxSigHashes has been made for it.  A TxSigHashes is safe for
+// concurrent use.
+type TxSigHashes struct {
+	tx *btcwire.MsgTx
+
+	// blankTxIns is every input serialized with an empty signature
+	// script, and blankTxInsNoSeq the same with zero sequence numbers,
+	// as they are for SigHashNone and SigHashSingle.
+	blankTxIns      []byte
+	blankTxInsNoSeq []byte
+
+	// txOuts is every output serialized, the output at index i starting
+	// at txOutOffsets[i] and ending at txOutOffsets[i+1].
+	txOuts       []byte
+	txOutOffsets []int
+
+	// The hashes of bip143, which are the hashes of bip341 hashed again.
+	hashPrevOuts []byte
+	hashSequence []byte
+	hashOutputs  []byte
+
+	// The outputs spent by the inputs and the hashes of bip341.
+	// prevOuts, shaAmounts and shaScriptPubKeys are nil if the previous
+	// outputs were not given.
+	prevOuts         []*btcwire.TxOut
+	shaPrevOuts      []byte
+	shaAmounts       []byte
+	shaScriptPubKeys []byte
+	shaSequences     []byte
+	shaOutputs       []byte
+}
+
+// NewTxSigHashes returns the signature hash state of tx.  prevOuts are the
+// outputs spent by each of the inputs of tx, in order, which taproot
+// signatures commit to.  They may be nil if no input spends a taproot output.
+func NewTxSigHashes(tx *btcwire.MsgTx, prevOuts []*btcwire.TxOut) *TxSigHashes {
+	h := TxSigHashes{tx: tx}
+
+	var ins, insNoSeq, outPoints, sequences bytes.Buffer
+	for _, txIn := range tx.TxIn {
+		for _, b := range []*bytes.Buffer{&ins, &insNoSeq, &outPoints} {
+			b.Write(txIn.PreviousOutpoint.Hash[:])
+			binary.Write(b, binary.LittleEndian,
+				txIn.PreviousOutpoint.Index)
+		}
+		ins.WriteByte(0x00)
+		insNoSeq.WriteByte(0x00)
+		binary.Write(&ins, binary.LittleEndian, txIn.Sequence)
+		binary.Write(&insNoSeq, binary.LittleEndian, uint32(0))
+		binary.Write(&sequences, binary.LittleEndian, txIn.Sequence)
+	}
+	h.blankTxIns = ins.Bytes()
+	h.blankTxInsNoSeq = insNoSeq.Bytes()
+
+	var outs bytes.Buffer
+	h.txOutOffsets = make([]int, 0, len(tx.TxOut)+1)
+	for _, txOut := range tx.TxOut {
+		h.txOutOffsets = append(h.txOutOffsets, outs.Len())
+		writeTxOut(&outs, txOut)
+	}
+	h.txOutOffsets = append(h.txOutOffsets, outs.Len())
+	h.txOuts = outs.Bytes()
+
+	h.shaPrevOuts = calcHash(outPoints.Bytes(), fastsha256.New())
+	h.shaSequences = calcHash(sequences.Bytes(), fastsha256.New())
+	h.shaOutputs = calcHash(h.txOuts, fastsha256.New())
+	h.hashPrevOuts = calcHash(h.shaPrevOuts, fastsha256.New())
+	h.hashSequence = calcHash(h.shaSequences, fastsha256.New())
+	h.hashOutputs = calcHash(h.shaOutputs, fastsha256.New())
+
+	if validPrevOuts(prevOuts, tx) {
+		var amounts, pkScripts bytes.Buffer
+		for _, prevOut := range prevOuts {
+			binary.Write(&amounts, binary.LittleEndian,
+				prevOut.Value)
+			writeVarInt(&pkScripts, uint64(len(prevOut.PkScript)))
+			pkScripts.Write(prevOut.PkScript)
+		}
+		h.prevOuts = prevOuts
+		h.shaAmounts = calcHash(amounts.Bytes(), fastsha256.New())
+		h.shaScriptPubKeys = calcHash(pkScripts.Bytes(),
+			fastsha256.New())
+	}
+
+	return &h
+}
+
+// writeTxIn serializes input idx of the transaction with sigScript and
+// sequence to w.
+func (h *TxSigHashes) writeTxIn(w io.Writer, idx int, sigScript []byte, sequence uint32) {
+	w.Write(h.blankTxIns[idx*blankTxInSize : idx*blankTxInSize+36])
+	writeVarInt(w, uint64(len(sigScript)))
+	w.Write(sigScript)
+	binary.Write(w, binary.LittleEndian, sequence)
+}
+
+// calcScriptHash returns the legacy signature hash of input idx for script
+// and hashType: the double sha256 of the transaction with only the input
+// being signed having a script, modified according to hashType, and the hash
+// type appended.  The serialization of the modified transaction is streamed
+// into the hash from the parts that have been serialized in advance.
+func (h *TxSigHashes) calcScriptHash(script []parsedOpcode, hashType byte, idx int) []byte {
+	tx := h.tx
+	baseType := hashType & 31
+	if baseType == SigHashSingle && idx >= len(tx.TxOut) {
+		// This was created by a buggy implementation.
+		// In this case we do the same as bitcoind and bitcoinj
+		// and return 1 (as a uint256 little endian) as an
+		// error. Unfortunately this was not checked anywhere
+		// and thus is treated as the actual
+		// hash.
+		hash := make([]byte, 32)
+		hash[0] = 0x01
+		return hash
+	}
+
+	// unparseScript cannot fail here, because removeOpcode only returns
+	// a valid script.
+	sigScript, _ := unparseScript(removeOpcode(script, OP_CODESEPARATOR))
+
+	w := fastsha256.New()
+	binary.Write(w, binary.LittleEndian, tx.Version)
+
+	// Only the input being signed has a script, and for SigHashNone and
+	// SigHashSingle only it keeps its sequence number.
+	if hashType&SigHashAnyOneCanPay != 0 {
+		writeVarInt(w, 1)
+		h.writeTxIn(w, idx, sigScript, tx.TxIn[idx].Sequence)
+	} else {
+		blankTxIns := h.blankTxIns
+		if baseType == SigHashNone || baseType == SigHashSingle {
+			blankTxIns = h.blankTxInsNoSeq
+		}
+		writeVarInt(w, uint64(len(tx.TxIn)))
+		w.Write(blankTxIns[:idx*blankTxInSize])
+		h.writeTxIn(w, idx, sigScript, tx.TxIn[idx].Sequence)
+		w.Write(blankTxIns[(idx+1)*blankTxInSize:])
+	}
+
+	switch baseType {
+	case SigHashNone:
+		writeVarInt(w, 0)
+	case SigHashSingle:
+		// The outputs before the one being signed are blanked to a
+		// value of -1 and an empty script.
+		writeVarInt(w, uint64(idx+1))
+		for i := 0; i < idx; i++ {
+			w.Write([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+				0xff, 0x00})
+		}
+		w.Write(h.txOuts[h.txOutOffsets[idx]:h.txOutOffsets[idx+1]])
+	default:
+		// Undefined hash types sign like SigHashAll.
+		writeVarInt(w, uint64(len(tx.TxOut)))
+		w.Write(h.txOuts)
+	}
+
+	binary.Write(w, binary.LittleEndian, tx.LockTime)
+	binary.Write(w, binary.LittleEndian, uint32(hashType))
+
+	return calcHash(w.Sum(nil), fastsha256.New())
+}
+
+// CalcSignatureHash returns the hash signed by a legacy signature with
+// hashType for input idx of the transaction, where script is the script being
+// run from the last OP_CODESEPARATOR with any signatures already removed.
+func (h *TxSigHashes) CalcSignatureHash(script []byte, hashType byte, idx int) ([]byte, error) {
+	if idx < 0 || idx >= len(h.tx.TxIn) {
+		return nil, StackErrInvalidIndex
+	}
+	pops, err := parseScript(script)
+	if err != nil {
+		return nil, err
+	}
+	return h.calcScriptHash(pops, hashType, idx), nil
+}
+
+// CalcWitnessSignatureHash is the same as the package function
+// CalcWitnessSignatureHash for the transaction.
+func (h *TxSigHashes) CalcWitnessSignatureHash(scriptCode []byte, hashType byte, idx int, amount int64) ([]byte, error) {
+	if idx < 0 || idx >= len(h.tx.TxIn) {
+		return nil, StackErrInvalidIndex
+	}
+	return calcWitnessSignatureHash(scriptCode, hashType, h, idx,
+		amount), nil
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcscript_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/conformal/btcscript"
+	"github.com/conformal/btcwire"
+	"testing"
+)
+
+// copySignatureHash returns the legacy signature hash of input idx of tx by
+// serializing a modified copy of the transaction, as the original algorithm
+// describes it.  script must not contain any pushes, so that its
+// OP_CODESEPARATORs can be removed byte by byte.
+func copySignatureHash(script []byte, hashType byte, tx *btcwire.MsgTx, idx int) []byte {
+	baseType := hashType & 31
+	if baseType == btcscript.SigHashSingle && idx >= len(tx.TxOut) {
+		hash := make([]byte, 32)
+		hash[0] = 0x01
+		return hash
+	}
+
+	var sigScript []byte
+	for _, op := range script {
+		if op != btcscript.OP_CODESEPARATOR {
+			sigScript = append(sigScript, op)
+		}
+	}
+
+	txCopy := tx.Copy()
+	for i, txIn := range txCopy.TxIn {
+		txIn.SignatureScript = nil
+		if i == idx {
+			txIn.SignatureScript = sigScript
+		} else if baseType == btcscript.SigHashNone ||
+			baseType == btcscript.SigHashSingle {
+			txIn.Sequence = 0
+		}
+	}
+	switch baseType {
+	case btcscript.SigHashNone:
+		txCopy.TxOut = nil
+	case btcscript.SigHashSingle:
+		txCopy.TxOut = txCopy.TxOut[:idx+1]
+		for i := 0; i < idx; i++ {
+			txCopy.TxOut[i] = btcwire.NewTxOut(-1, nil)
+		}
+	}
+	if hashType&btcscript.SigHashAnyOneCanPay != 0 {
+		txCopy.TxIn = txCopy.TxIn[idx : idx+1]
+	}
+
+	var b bytes.Buffer
+	txCopy.Serialize(&b)
+	binary.Write(&b, binary.LittleEndian, uint32(hashType))
+	return btcwire.DoubleSha256(b.Bytes())
+}
+
+// TestTxSigHashes checks that the signature hashes computed from TxSigHashes
+// are the same as those computed from a copy of the transaction, for every
+// input and hash type.
+func TestTxSigHashes(t *testing.T) {
+	tx := btcwire.NewMsgTx()
+	tx.LockTime = 500000
+	for i := 0; i < 4; i++ {
+		outPoint := btcwire.OutPoint{Index: uint32(i)}
+		outPoint.Hash[0] = byte(i)
+		txIn := btcwire.NewTxIn(&outPoint,
+			[]byte{btcscript.OP_1, byte(i)})
+		txIn.Sequence = uint32(0xfffffff0 + i)
+		tx.AddTxIn(txIn)
+	}
+	// Fewer outputs than inputs, so that SigHashSingle has no output to
+	// sign for the last inputs.
+	for i := 0; i < 2; i++ {
+		tx.AddTxOut(btcwire.NewTxOut(int64(1000*(i+1)),
+			bytes.Repeat([]byte{btcscript.OP_NOP}, i+1)))
+	}
+	script := []byte{btcscript.OP_DUP, btcscript.OP_CODESEPARATOR,
+		btcscript.OP_CHECKSIG}
+
+	hashTypes := []byte{btcscript.SigHashOld, btcscript.SigHashAll,
+		btcscript.SigHashNone, btcscript.SigHashSingle, 0x04, 0x21}
+	sigHashes := btcscript.NewTxSigHashes(tx, nil)
+	for idx := range tx.TxIn {
+		for _, baseType := range hashTypes {
+			for _, anyoneCanPay := range []byte{0,
+				btcscript.SigHashAnyOneCanPay} {
+				hashType := baseType | anyoneCanPay
+				want := copySignatureHash(script, hashType,
+					tx, idx)
+				got, err := sigHashes.CalcSignatureHash(script,
+					hashType, idx)
+				if err != nil {
+					t.Fatalf("CalcSignatureHash: %v", err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("input %d hash type %x: got "+
+						"%x, want %x", idx, hashType,
+						got, want)
+				}
+			}
+		}
+	}
+
+	_, err := sigHashes.CalcSignatureHash(script, btcscript.SigHashAll,
+		len(tx.TxIn))
+	if err != btcscript.StackErrInvalidIndex {
+		t.Errorf("invalid index: got %v, want %v", err,
+			btcscript.StackErrInvalidIndex)
+	}
+}
@@ -4,75 +4,6 @@
 
 package btcscript
 
-import (
-	"math/big"
-)
-
-// asInt converts a byte array to a bignum by treating it as a little endian
-// number with sign bit.
-func asInt(v []byte) *big.Int {
-	if len(v) == 0 {
-		return big.NewInt(0)
-	}
-	negative := false
-	origlen := len(v)
-	msb := v[len(v)-1]
-	if msb&0x80 == 0x80 {
-		negative = true
-		// remove sign bit
-		msb &= 0x7f
-	}
-	// trim leading 0 bytes
-	for ; msb == 0; msb = v[len(v)-1] {
-		v = v[:len(v)-1]
-		if len(v) == 0 {
-			break
-		}
-	}
-	// reverse bytes with a copy since stack is immutable.
-	intArray := make([]byte, len(v))
-	for i := range v {
-		intArray[len(v)-i-1] = v[i]
-	}
-	// IFF the value is negative and no 0 bytes were trimmed,
-	// the leading byte needs to be sign corrected
-	if negative && len(intArray) == origlen {
-		intArray[0] &= 0x7f
-	}
-
-	num := new(big.Int).SetBytes(intArray)
-	if negative {
-		num = num.Neg(num)
-	}
-	return num
-}
-
-// fromInt provies a Big.Int in little endian format with the high bit of the
-// msb donating sign.
-func fromInt(v *big.Int) []byte {
-	negative := false
-	if v.Sign() == -1 {
-		negative = true
-	}
-	// Int.Bytes() trims leading zeros for us, so we don't have to.
-	b := v.Bytes()
-	if len(b) == 0 {
-		return []byte{}
-	}
-	arr := make([]byte, len(b))
-	for i := range b {
-		arr[len(b)-i-1] = b[i]
-	}
-	// if would otherwise be negative, add a zero byte
-	if arr[len(arr)-1]&0x80 == 0x80 {
-		arr = append(arr, 0)
-	}
-	if negative {
-		arr[len(arr)-1] |= 0x80
-	}
-	return arr
-}
-
 // asBool gets the boolean value of the byte array.
 func asBool(t []byte) bool {
 	for i := range t {
@@ -95,7 +26,8 @@ func fromBool(v bool) []byte {
 // Objects may be shared,  therefore in usage if a value is to be changed it
 // *must* be deep-copied first to avoid changing other values on the stack.
 type Stack struct {
-	stk [][]byte
+	stk               [][]byte
+	verifyMinimalData bool
 }
 
 // PushByteArray adds the given back array to the top of the stack.
@@ -103,10 +35,10 @@ func (s *Stack) PushByteArray(so []byte) {
 	s.stk = append(s.stk, so)
 }
 
-// PushInt converts the provided bignum to a suitable byte array then pushes
-// it onto the top of the stack.
-func (s *Stack) PushInt(val *big.Int) {
-	s.PushByteArray(fromInt(val))
+// PushInt converts the provided script number to a suitable byte array then
+// pushes it onto the top of the stack.
+func (s *Stack) PushInt(val ScriptNum) {
+	s.PushByteArray(val.Bytes())
 }
 
 // PushBool converts the provided boolean to a suitable byte array then pushes
@@ -120,14 +52,15 @@ func (s *Stack) PopByteArray() ([]byte, error) {
 	return s.nipN(0)
 }
 
-// PopInt pops the value off the top of the stack, converts it into a bignum and
-// returns it.
-func (s *Stack) PopInt() (*big.Int, error) {
+// PopInt pops the value off the top of the stack, converts it into a script
+// number and returns it.  Values longer than 4 bytes are rejected with
+// StackErrNumberTooBig.
+func (s *Stack) PopInt() (ScriptNum, error) {
 	so, err := s.PopByteArray()
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	return asInt(so), nil
+	return makeScriptNum(so, s.verifyMinimalData, defaultScriptNumLen)
 }
 
 // PopBool pops the value off the top of the stack, converts it into a bool and
@@ -149,13 +82,15 @@ func (s *Stack) PeekByteArray(idx int) (so []byte, err error) {
 	return s.stk[sz-idx-1], nil
 }
 
-// PeekInt returns the nth item on the stack as a bignum without removing it.
-func (s *Stack) PeekInt(idx int) (i *big.Int, err error) {
+// PeekInt returns the nth item on the stack as a script number without
+// removing it.  Values longer than 4 bytes are rejected with
+// StackErrNumberTooBig.
+func (s *Stack) PeekInt(idx int) (i ScriptNum, err error) {
 	so, err := s.PeekByteArray(idx)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	return asInt(so), nil
+	return makeScriptNum(so, s.verifyMinimalData, defaultScriptNumLen)
 }
 
 // PeekBool returns the nth item on the stack as a bool without removing it.
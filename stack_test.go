@@ -9,7 +9,6 @@ import (
 	"errors"
 	"fmt"
 	"github.com/conformal/btcscript"
-	"math/big"
 	"testing"
 )
 
@@ -179,7 +178,7 @@ var stackTests = []stackTest{
 			if err != nil {
 				return err
 			}
-			if v.Sign() != 0 {
+			if v != 0 {
 				return errors.New("0 != 0 on popInt")
 			}
 			return nil
@@ -195,7 +194,7 @@ var stackTests = []stackTest{
 			if err != nil {
 				return err
 			}
-			if v.Sign() != 0 {
+			if v != 0 {
 				return errors.New("-0 != 0 on popInt")
 			}
 			return nil
@@ -211,7 +210,7 @@ var stackTests = []stackTest{
 			if err != nil {
 				return err
 			}
-			if v.Cmp(big.NewInt(1)) != 0 {
+			if v != 1 {
 				return errors.New("1 != 1 on popInt")
 			}
 			return nil
@@ -227,8 +226,8 @@ var stackTests = []stackTest{
 			if err != nil {
 				return err
 			}
-			if v.Cmp(big.NewInt(1)) != 0 {
-				fmt.Printf("%v != %v\n", v, big.NewInt(1))
+			if v != 1 {
+				fmt.Printf("%v != %v\n", v, 1)
 				return errors.New("1 != 1 on popInt")
 			}
 			return nil
@@ -244,7 +243,7 @@ var stackTests = []stackTest{
 			if err != nil {
 				return err
 			}
-			if v.Cmp(big.NewInt(-1)) != 0 {
+			if v != -1 {
 				return errors.New("1 != 1 on popInt")
 			}
 			return nil
@@ -260,8 +259,8 @@ var stackTests = []stackTest{
 			if err != nil {
 				return err
 			}
-			if v.Cmp(big.NewInt(-1)) != 0 {
-				fmt.Printf("%v != %v\n", v, big.NewInt(-1))
+			if v != -1 {
+				fmt.Printf("%v != %v\n", v, -1)
 				return errors.New("-1 != -1 on popInt")
 			}
 			return nil
@@ -269,7 +268,7 @@ var stackTests = []stackTest{
 		nil,
 		[][]byte{},
 	},
-	// Triggers the multibyte case in asInt
+	// Triggers the multibyte case in PopInt
 	{
 		"popInt -513",
 		[][]byte{{0x1, 0x82}},
@@ -278,8 +277,8 @@ var stackTests = []stackTest{
 			if err != nil {
 				return err
 			}
-			if v.Cmp(big.NewInt(-513)) != 0 {
-				fmt.Printf("%v != %v\n", v, big.NewInt(-513))
+			if v != -513 {
+				fmt.Printf("%v != %v\n", v, -513)
 				return errors.New("1 != 1 on popInt")
 			}
 			return nil
@@ -287,7 +286,18 @@ var stackTests = []stackTest{
 		nil,
 		[][]byte{},
 	},
-	// Confirm that the asInt code doesn't modify the base data.
+	// Numbers are limited to 4 bytes.
+	{
+		"popInt 5 bytes",
+		[][]byte{{0x1, 0x0, 0x0, 0x0, 0x0}},
+		func(stack *btcscript.Stack) error {
+			_, err := stack.PopInt()
+			return err
+		},
+		btcscript.StackErrNumberTooBig,
+		[][]byte{},
+	},
+	// Confirm that the PeekInt code doesn't modify the base data.
 	{
 		"peekint nomodify -1",
 		[][]byte{{0x01, 0x00, 0x00, 0x80}},
@@ -296,8 +306,8 @@ var stackTests = []stackTest{
 			if err != nil {
 				return err
 			}
-			if v.Cmp(big.NewInt(-1)) != 0 {
-				fmt.Printf("%v != %v\n", v, big.NewInt(-1))
+			if v != -1 {
+				fmt.Printf("%v != %v\n", v, -1)
 				return errors.New("-1 != -1 on popInt")
 			}
 			return nil
@@ -309,7 +319,7 @@ var stackTests = []stackTest{
 		"PushInt 0",
 		[][]byte{},
 		func(stack *btcscript.Stack) error {
-			stack.PushInt(big.NewInt(0))
+			stack.PushInt(btcscript.ScriptNum(0))
 			return nil
 		},
 		nil,
@@ -319,7 +329,7 @@ var stackTests = []stackTest{
 		"PushInt 1",
 		[][]byte{},
 		func(stack *btcscript.Stack) error {
-			stack.PushInt(big.NewInt(1))
+			stack.PushInt(btcscript.ScriptNum(1))
 			return nil
 		},
 		nil,
@@ -329,7 +339,7 @@ var stackTests = []stackTest{
 		"PushInt -1",
 		[][]byte{},
 		func(stack *btcscript.Stack) error {
-			stack.PushInt(big.NewInt(-1))
+			stack.PushInt(btcscript.ScriptNum(-1))
 			return nil
 		},
 		nil,
@@ -339,7 +349,7 @@ var stackTests = []stackTest{
 		"PushInt two bytes",
 		[][]byte{},
 		func(stack *btcscript.Stack) error {
-			stack.PushInt(big.NewInt(256))
+			stack.PushInt(btcscript.ScriptNum(256))
 			return nil
 		},
 		nil,
@@ -351,7 +361,7 @@ var stackTests = []stackTest{
 		[][]byte{},
 		func(stack *btcscript.Stack) error {
 			// this will have the highbit set
-			stack.PushInt(big.NewInt(128))
+			stack.PushInt(btcscript.ScriptNum(128))
 			return nil
 		},
 		nil,
@@ -517,7 +527,7 @@ var stackTests = []stackTest{
 		"PushInt PopBool",
 		[][]byte{},
 		func(stack *btcscript.Stack) error {
-			stack.PushInt(big.NewInt(1))
+			stack.PushInt(btcscript.ScriptNum(1))
 			val, err := stack.PopBool()
 			if err != nil {
 				return err
@@ -535,7 +545,7 @@ var stackTests = []stackTest{
 		"PushInt PopBool 2",
 		[][]byte{},
 		func(stack *btcscript.Stack) error {
-			stack.PushInt(big.NewInt(0))
+			stack.PushInt(btcscript.ScriptNum(0))
 			val, err := stack.PopBool()
 			if err != nil {
 				return err
@@ -553,7 +563,7 @@ var stackTests = []stackTest{
 		"PushInt PopBool 2",
 		[][]byte{},
 		func(stack *btcscript.Stack) error {
-			stack.PushInt(big.NewInt(0))
+			stack.PushInt(btcscript.ScriptNum(0))
 			val, err := stack.PopBool()
 			if err != nil {
 				return err
@@ -903,7 +913,7 @@ var stackTests = []stackTest{
 			if err != nil {
 				return err
 			}
-			if val.Cmp(big.NewInt(1)) != 0 {
+			if val != 1 {
 				return errors.New("invalid result")
 			}
 			return nil
@@ -921,7 +931,7 @@ var stackTests = []stackTest{
 			if err != nil {
 				return err
 			}
-			if val.Cmp(big.NewInt(0)) != 0 {
+			if val != 0 {
 				return errors.New("invalid result")
 			}
 			return nil
@@ -933,14 +943,14 @@ var stackTests = []stackTest{
 		"pop int",
 		[][]byte{},
 		func(stack *btcscript.Stack) error {
-			stack.PushInt(big.NewInt(1))
+			stack.PushInt(btcscript.ScriptNum(1))
 			// Peek int is otherwise pretty well tested, just check
 			// it works.
 			val, err := stack.PopInt()
 			if err != nil {
 				return err
 			}
-			if val.Cmp(big.NewInt(1)) != 0 {
+			if val != 1 {
 				return errors.New("invalid result")
 			}
 			return nil
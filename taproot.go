@@ -0,0 +1,462 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcscript
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/conformal/btcec"
+	"github.com/conformal/btcwire"
+	"github.com/conformal/fastsha256"
+	"math/big"
+)
+
+// SigHashDefault is the taproot (bip341) hash type of 64-byte signatures,
+// which sign like SigHashAll but without a hash type byte.
+const SigHashDefault = 0x0
+
+// taprootAnnexTag is the first byte of the optional last witness item of a
+// taproot spend, the annex, which is left for future extensions.
+const taprootAnnexTag = 0x50
+
+const (
+	// tapscriptLeafVersion is the leaf version of scripts run under the
+	// tapscript (bip342) rules.  Other leaf versions are left for future
+	// soft forks.
+	tapscriptLeafVersion = 0xc0
+
+	// taprootControlBaseSize is the size of a control block without any
+	// merkle path nodes: the leaf version and parity byte and the
+	// internal key.
+	taprootControlBaseSize = 33
+
+	// taprootControlNodeSize is the size of each node of the merkle path
+	// in a control block.
+	taprootControlNodeSize = 32
+
+	// taprootControlMaxNodes is the maximum depth of the script tree.
+	taprootControlMaxNodes = 128
+
+	// tapscriptSigOpsCost is the part of the signature budget used by each
+	// signature that is checked in a tapscript.
+	tapscriptSigOpsCost = 50
+
+	// tapscriptSigOpsBase is added to the size of the witness to give the
+	// signature budget of a tapscript.
+	tapscriptSigOpsBase = 50
+)
+
+// taggedHash returns the bip340 tagged hash of msg,
+// sha256(sha256(tag) || sha256(tag) || msg).
+func taggedHash(tag string, msg ...[]byte) []byte {
+	tagHash := calcHash([]byte(tag), fastsha256.New())
+	h := fastsha256.New()
+	h.Write(tagHash)
+	h.Write(tagHash)
+	for _, m := range msg {
+		h.Write(m)
+	}
+	return h.Sum(nil)
+}
+
+// liftX returns the point with the given x coordinate and an even y
+// coordinate (bip340), or nil if there is none on the curve.
+func liftX(x *big.Int) (*big.Int, *big.Int) {
+	curve := btcec.S256()
+	p := curve.P
+	if x.Cmp(p) >= 0 {
+		return nil, nil
+	}
+
+	// y^2 = x^3 + 7.  p = 3 mod 4, so a square root of c, if there is
+	// one, is c^((p+1)/4).
+	c := new(big.Int).Exp(x, big.NewInt(3), p)
+	c.Add(c, curve.B)
+	c.Mod(c, p)
+	e := new(big.Int).Add(p, big.NewInt(1))
+	e.Rsh(e, 2)
+	y := new(big.Int).Exp(c, e, p)
+	if new(big.Int).Exp(y, big.NewInt(2), p).Cmp(c) != 0 {
+		return nil, nil
+	}
+	if y.Bit(0) == 1 {
+		y.Sub(p, y)
+	}
+	return x, y
+}
+
+// verifySchnorr returns whether sig is a valid bip340 signature of the 32-byte
+// msg for the x-only public key pubKey.
+func verifySchnorr(pubKey, msg, sig []byte) bool {
+	if len(pubKey) != 32 || len(sig) != 64 {
+		return false
+	}
+	curve := btcec.S256()
+
+	px, py := liftX(new(big.Int).SetBytes(pubKey))
+	if px == nil {
+		return false
+	}
+	r := new(big.Int).SetBytes(sig[:32])
+	if r.Cmp(curve.P) >= 0 {
+		return false
+	}
+	s := new(big.Int).SetBytes(sig[32:])
+	if s.Cmp(curve.N) >= 0 {
+		return false
+	}
+
+	e := new(big.Int).SetBytes(taggedHash("BIP0340/challenge", sig[:32],
+		pubKey, msg))
+	e.Mod(e, curve.N)
+
+	// R = s*G - e*P
+	sx, sy := curve.ScalarBaseMult(s.Bytes())
+	e.Sub(curve.N, e)
+	ex, ey := curve.ScalarMult(px, py, e.Bytes())
+	rx, ry := curve.Add(sx, sy, ex, ey)
+
+	// The point at infinity is (0, 0), which is not on the curve.
+	if rx.Sign() == 0 && ry.Sign() == 0 {
+		return false
+	}
+	return ry.Bit(0) == 0 && rx.Cmp(r) == 0
+}
+
+// validTaprootHashType returns whether hashType is one of the hash types
+// defined for taproot signatures.
+func validTaprootHashType(hashType byte) bool {
+	switch hashType & ^byte(SigHashAnyOneCanPay) {
+	case SigHashDefault:
+		return hashType == SigHashDefault
+	case SigHashAll, SigHashNone, SigHashSingle:
+		return true
+	}
+	return false
+}
+
+// calcTaprootSignatureHash implements CalcTaprootSignatureHash for sigHashes,
+// which must have been made with the previous outputs.  annex is the annex of
+// the input, if any, and ext is the extension of the message for script path
+// spends (bip342), nil for key path spends.
+func calcTaprootSignatureHash(hashType byte, sigHashes *TxSigHashes, idx int, annex, ext []byte) ([]byte, error) {
+	tx := sigHashes.tx
+	if !validTaprootHashType(hashType) {
+		return nil, StackErrSchnorrSigHashType
+	}
+	anyoneCanPay := hashType&SigHashAnyOneCanPay != 0
+	baseType := hashType & 0x03
+	if baseType == SigHashSingle && idx >= len(tx.TxOut) {
+		return nil, StackErrSchnorrSigHashType
+	}
+
+	var b bytes.Buffer
+	b.WriteByte(0x00) // epoch
+	b.WriteByte(hashType)
+	binary.Write(&b, binary.LittleEndian, tx.Version)
+	binary.Write(&b, binary.LittleEndian, tx.LockTime)
+
+	if !anyoneCanPay {
+		b.Write(sigHashes.shaPrevOuts)
+		b.Write(sigHashes.shaAmounts)
+		b.Write(sigHashes.shaScriptPubKeys)
+		b.Write(sigHashes.shaSequences)
+	}
+	if baseType != SigHashNone && baseType != SigHashSingle {
+		b.Write(sigHashes.shaOutputs)
+	}
+
+	var spendType byte
+	if ext != nil {
+		spendType |= 2
+	}
+	if annex != nil {
+		spendType |= 1
+	}
+	b.WriteByte(spendType)
+
+	if anyoneCanPay {
+		txIn := tx.TxIn[idx]
+		b.Write(txIn.PreviousOutpoint.Hash[:])
+		binary.Write(&b, binary.LittleEndian,
+			txIn.PreviousOutpoint.Index)
+		writeTxOut(&b, sigHashes.prevOuts[idx])
+		binary.Write(&b, binary.LittleEndian, txIn.Sequence)
+	} else {
+		binary.Write(&b, binary.LittleEndian, uint32(idx))
+	}
+	if annex != nil {
+		var a bytes.Buffer
+		writeVarInt(&a, uint64(len(annex)))
+		a.Write(annex)
+		b.Write(calcHash(a.Bytes(), fastsha256.New()))
+	}
+	if baseType == SigHashSingle {
+		var o bytes.Buffer
+		writeTxOut(&o, tx.TxOut[idx])
+		b.Write(calcHash(o.Bytes(), fastsha256.New()))
+	}
+	b.Write(ext)
+
+	return taggedHash("TapSighash", b.Bytes()), nil
+}
+
+// CalcTaprootSignatureHash returns the hash that is signed for a key path
+// spend of input idx of tx spending a taproot output, using the algorithm of
+// bip341.  prevOuts are the outputs spent by each of the inputs of tx, in
+// order, which taproot signatures commit to.
+func CalcTaprootSignatureHash(hashType byte, tx *btcwire.MsgTx, idx int, prevOuts []*btcwire.TxOut) ([]byte, error) {
+	if idx < 0 || idx >= len(tx.TxIn) {
+		return nil, StackErrInvalidIndex
+	}
+	if !validPrevOuts(prevOuts, tx) {
+		return nil, StackErrInvalidPrevOuts
+	}
+	return calcTaprootSignatureHash(hashType, NewTxSigHashes(tx, prevOuts),
+		idx, nil, nil)
+}
+
+// tapscriptSigHashExt returns the extension of the message signed in a
+// tapscript (bip342): the leaf hash, a key version of 0 and the position of
+// the last executed OP_CODESEPARATOR.
+func tapscriptSigHashExt(leafHash []byte, codeSepPos uint32) []byte {
+	ext := make([]byte, 0, len(leafHash)+5)
+	ext = append(ext, leafHash...)
+	ext = append(ext, 0x00)
+	var pos [4]byte
+	binary.LittleEndian.PutUint32(pos[:], codeSepPos)
+	return append(ext, pos[:]...)
+}
+
+// CalcTapscriptSignatureHash returns the hash that is signed in a tapscript
+// (bip342) run by a script path spend of input idx of tx.  leafHash is the
+// tapleaf hash of the script and codeSepPos the opcode position of the last
+// OP_CODESEPARATOR executed before the signature check, or 0xffffffff if
+// there is none.
+func CalcTapscriptSignatureHash(hashType byte, tx *btcwire.MsgTx, idx int, prevOuts []*btcwire.TxOut, leafHash []byte, codeSepPos uint32) ([]byte, error) {
+	if idx < 0 || idx >= len(tx.TxIn) {
+		return nil, StackErrInvalidIndex
+	}
+	if !validPrevOuts(prevOuts, tx) {
+		return nil, StackErrInvalidPrevOuts
+	}
+	return calcTaprootSignatureHash(hashType, NewTxSigHashes(tx, prevOuts),
+		idx, nil, tapscriptSigHashExt(leafHash, codeSepPos))
+}
+
+// checkSchnorrSignature returns nil if sig, with an optional hash type byte,
+// is a valid signature of the input being spent for the x-only pubKey.  ext
+// is the extension of the signed message, nil for key path spends.
+func (m *Script) checkSchnorrSignature(sig, pubKey, ext []byte) error {
+	hashType := byte(SigHashDefault)
+	switch len(sig) {
+	case 64:
+	case 65:
+		hashType = sig[64]
+		if hashType == SigHashDefault {
+			return StackErrSchnorrSigHashType
+		}
+		sig = sig[:64]
+	default:
+		return StackErrSchnorrSigSize
+	}
+
+	hash, err := calcTaprootSignatureHash(hashType, m.txSigHashes(),
+		m.txidx, m.taprootAnnex, ext)
+	if err != nil {
+		return err
+	}
+	if !verifySchnorr(pubKey, hash, sig) {
+		return StackErrSchnorrSig
+	}
+	return nil
+}
+
+// checkTapscriptSig checks sig for the public key pubKey in a tapscript, as
+// OP_CHECKSIG and OP_CHECKSIGADD do.  It returns false for an empty signature,
+// and an error for any other that is not valid.  Public keys that are not 32
+// bytes are left for future soft forks and accept any non-empty signature.
+func (m *Script) checkTapscriptSig(sig, pubKey []byte) (bool, error) {
+	if len(sig) != 0 {
+		m.sigOpsBudget -= tapscriptSigOpsCost
+		if m.sigOpsBudget < 0 {
+			return false, StackErrTaprootMaxSigOps
+		}
+	}
+	if len(pubKey) == 0 {
+		return false, StackErrPubKeyType
+	}
+	if len(sig) == 0 {
+		return false, nil
+	}
+	if len(pubKey) != 32 {
+		return true, nil
+	}
+
+	ext := tapscriptSigHashExt(m.tapLeafHash, m.tapCodeSepPos)
+	if err := m.checkSchnorrSignature(sig, pubKey, ext); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// isOpSuccess returns whether opcode is one of the OP_SUCCESSx opcodes of
+// bip342, whose presence anywhere in a tapscript makes the spend succeed
+// so that they may be given meaning by future soft forks.
+func isOpSuccess(opcode byte) bool {
+	switch {
+	case opcode == 80 || opcode == 98:
+		return true
+	case opcode >= 126 && opcode <= 129:
+		return true
+	case opcode >= 131 && opcode <= 134:
+		return true
+	case opcode >= 137 && opcode <= 138:
+		return true
+	case opcode >= 141 && opcode <= 142:
+		return true
+	case opcode >= 149 && opcode <= 153:
+		return true
+	case opcode >= 187 && opcode <= 254:
+		return true
+	}
+	return false
+}
+
+// verifyTaprootCommitment checks that the output key outputKey commits to
+// script through controlBlock, which holds the leaf version, the parity of
+// the output key, the internal key and the merkle path from the leaf to the
+// root of the script tree.  It returns the leaf hash of script.
+func verifyTaprootCommitment(controlBlock, outputKey, script []byte) ([]byte, error) {
+	size := len(controlBlock)
+	if size < taprootControlBaseSize ||
+		(size-taprootControlBaseSize)%taprootControlNodeSize != 0 ||
+		(size-taprootControlBaseSize)/taprootControlNodeSize >
+			taprootControlMaxNodes {
+		return nil, StackErrTaprootControlBlock
+	}
+	curve := btcec.S256()
+
+	internalKey := controlBlock[1:taprootControlBaseSize]
+	px, py := liftX(new(big.Int).SetBytes(internalKey))
+	if px == nil {
+		return nil, StackErrWitnessProgramMismatch
+	}
+
+	var leaf bytes.Buffer
+	leaf.WriteByte(controlBlock[0] & 0xfe)
+	writeVarInt(&leaf, uint64(len(script)))
+	leaf.Write(script)
+	leafHash := taggedHash("TapLeaf", leaf.Bytes())
+
+	// Branches hash their children in lexicographic order, so the path
+	// does not need to say on which side each node is.
+	k := leafHash
+	for i := taprootControlBaseSize; i < size; i += taprootControlNodeSize {
+		node := controlBlock[i : i+taprootControlNodeSize]
+		if bytes.Compare(k, node) < 0 {
+			k = taggedHash("TapBranch", k, node)
+		} else {
+			k = taggedHash("TapBranch", node, k)
+		}
+	}
+
+	// Q = P + t*G, where t = hash(P || k)
+	t := new(big.Int).SetBytes(taggedHash("TapTweak", internalKey, k))
+	if t.Cmp(curve.N) >= 0 {
+		return nil, StackErrWitnessProgramMismatch
+	}
+	tx, ty := curve.ScalarBaseMult(t.Bytes())
+	qx, qy := curve.Add(px, py, tx, ty)
+	if qx.Cmp(new(big.Int).SetBytes(outputKey)) != 0 ||
+		qy.Bit(0) != uint(controlBlock[0]&1) {
+		return nil, StackErrWitnessProgramMismatch
+	}
+	return leafHash, nil
+}
+
+// witnessSize returns the serialized size of witness.
+func witnessSize(witness TxWitness) int {
+	var b bytes.Buffer
+	writeVarInt(&b, uint64(len(witness)))
+	for _, item := range witness {
+		writeVarInt(&b, uint64(len(item)))
+	}
+	size := b.Len()
+	for _, item := range witness {
+		size += len(item)
+	}
+	return size
+}
+
+// verifyTaproot validates the spend of a taproot (bip341) output.  A witness
+// of a single item, after removing the annex if there is one, is a key path
+// spend: a signature for the output key, which is the witness program.  A
+// longer witness is a script path spend: a script, the control block proving
+// the output key commits to it, and before them the input of the script.
+func (m *Script) verifyTaproot() error {
+	witness := m.witness
+	if len(witness) == 0 {
+		return StackErrWitnessProgramEmpty
+	}
+	last := witness[len(witness)-1]
+	if len(witness) >= 2 && len(last) > 0 && last[0] == taprootAnnexTag {
+		m.taprootAnnex = last
+		witness = witness[:len(witness)-1]
+	}
+
+	if len(witness) == 1 {
+		err := m.checkSchnorrSignature(witness[0], m.witnessProgram,
+			nil)
+		if err != nil {
+			return err
+		}
+		m.SetStack([][]byte{{1}})
+		return nil
+	}
+
+	controlBlock := witness[len(witness)-1]
+	script := witness[len(witness)-2]
+	stack := witness[:len(witness)-2]
+	leafHash, err := verifyTaprootCommitment(controlBlock,
+		m.witnessProgram, script)
+	if err != nil {
+		return err
+	}
+
+	// Unknown leaf versions, and tapscripts with an OP_SUCCESSx opcode
+	// even if they fail to parse after it, succeed unconditionally.
+	if controlBlock[0]&0xfe != tapscriptLeafVersion {
+		m.SetStack([][]byte{{1}})
+		return nil
+	}
+	pops, err := parseScript(script)
+	for _, pop := range pops {
+		if isOpSuccess(pop.opcode.value) {
+			m.SetStack([][]byte{{1}})
+			return nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(stack) > MaxStackSize {
+		return StackErrStackOverflow
+	}
+	for _, item := range stack {
+		if len(item) > MaxScriptElementSize {
+			return StackErrElementTooBig
+		}
+	}
+
+	m.tapLeafHash = leafHash
+	m.tapCodeSepPos = 0xffffffff
+	m.sigOpsBudget = tapscriptSigOpsBase + witnessSize(m.witness)
+	m.witnessScript = true
+	m.scripts = append(m.scripts, pops)
+	m.SetStack(stack)
+	return nil
+}
@@ -0,0 +1,601 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcscript_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"github.com/conformal/btcec"
+	"github.com/conformal/btcscript"
+	"github.com/conformal/btcwire"
+	"math/big"
+	"testing"
+)
+
+// TestVerifySchnorr checks schnorr signature verification against some of the
+// bip340 test vectors.
+func TestVerifySchnorr(t *testing.T) {
+	tests := []struct {
+		name   string
+		pubKey string
+		msg    string
+		sig    string
+		valid  bool
+	}{
+		{
+			name: "vector 0",
+			pubKey: "f9308a019258c31049344f85f89d5229b531c845836f99b0" +
+				"8601f113bce036f9",
+			msg: "0000000000000000000000000000000000000000000000000000" +
+				"000000000000",
+			sig: "e907831f80848d1069a5371b402410364bdf1c5f8307b0084c55" +
+				"f1ce2dca821525f66a4a85ea8b71e482a74f382d2ce5ebeee8fd" +
+				"b2172f477df4900d310536c0",
+			valid: true,
+		},
+		{
+			name: "vector 1",
+			pubKey: "dff1d77f2a671c5f36183726db2341be58feae1da2deced8" +
+				"43240f7b502ba659",
+			msg: "243f6a8885a308d313198a2e03707344a4093822299f31d0082e" +
+				"fa98ec4e6c89",
+			sig: "6896bd60eeae296db48a229ff71dfe071bde413e6d43f917dc8d" +
+				"cf8c78de33418906d11ac976abccb20b091292bff4ea897efcb6" +
+				"39ea871cfa95f6de339e4b0a",
+			valid: true,
+		},
+		{
+			name: "vector 1 other message",
+			pubKey: "dff1d77f2a671c5f36183726db2341be58feae1da2deced8" +
+				"43240f7b502ba659",
+			msg: "243f6a8885a308d313198a2e03707344a4093822299f31d0082e" +
+				"fa98ec4e6c8a",
+			sig: "6896bd60eeae296db48a229ff71dfe071bde413e6d43f917dc8d" +
+				"cf8c78de33418906d11ac976abccb20b091292bff4ea897efcb6" +
+				"39ea871cfa95f6de339e4b0a",
+		},
+		{
+			name: "vector 1 s out of range",
+			pubKey: "dff1d77f2a671c5f36183726db2341be58feae1da2deced8" +
+				"43240f7b502ba659",
+			msg: "243f6a8885a308d313198a2e03707344a4093822299f31d0082e" +
+				"fa98ec4e6c89",
+			sig: "6896bd60eeae296db48a229ff71dfe071bde413e6d43f917dc8d" +
+				"cf8c78de3341ffffffffffffffffffffffffffffffffffffffff" +
+				"ffffffffffffffffffffffff",
+		},
+		{
+			name: "public key not on the curve",
+			pubKey: "eefdea4cdb677750a420fee807eacf21eb9898ae79b97687" +
+				"66e4faa04a2d4a34",
+			msg: "243f6a8885a308d313198a2e03707344a4093822299f31d0082e" +
+				"fa98ec4e6c89",
+			sig: "6896bd60eeae296db48a229ff71dfe071bde413e6d43f917dc8d" +
+				"cf8c78de33418906d11ac976abccb20b091292bff4ea897efcb6" +
+				"39ea871cfa95f6de339e4b0a",
+		},
+	}
+
+	for _, test := range tests {
+		valid := btcscript.TstVerifySchnorr(decodeHex(test.pubKey),
+			decodeHex(test.msg), decodeHex(test.sig))
+		if valid != test.valid {
+			t.Errorf("%s: got %v, want %v", test.name, valid,
+				test.valid)
+		}
+	}
+}
+
+// taggedHash returns the bip340 tagged hash of msg.
+func taggedHash(tag string, msg ...[]byte) []byte {
+	tagHash := sha256.Sum256([]byte(tag))
+	h := sha256.New()
+	h.Write(tagHash[:])
+	h.Write(tagHash[:])
+	for _, m := range msg {
+		h.Write(m)
+	}
+	return h.Sum(nil)
+}
+
+// pad32 returns b left padded with zeros to 32 bytes.
+func pad32(b []byte) []byte {
+	return append(make([]byte, 32-len(b)), b...)
+}
+
+// schnorrKey returns the private key d, negated if needed so that its public
+// key has an even y coordinate, and the x-only public key.
+func schnorrKey(d *big.Int) (*big.Int, []byte) {
+	curve := btcec.S256()
+	px, py := curve.ScalarBaseMult(d.Bytes())
+	if py.Bit(0) == 1 {
+		d = new(big.Int).Sub(curve.N, d)
+	}
+	return d, pad32(px.Bytes())
+}
+
+// schnorrSign returns a bip340 signature of hash by the private key d, which
+// must come from schnorrKey.  The nonce is derived from d and hash, which is
+// good enough for tests.
+func schnorrSign(d *big.Int, hash []byte) []byte {
+	curve := btcec.S256()
+	_, pubKey := schnorrKey(d)
+
+	k := new(big.Int).SetBytes(taggedHash("test/nonce", pad32(d.Bytes()),
+		hash))
+	k.Mod(k, curve.N)
+	rx, ry := curve.ScalarBaseMult(k.Bytes())
+	if ry.Bit(0) == 1 {
+		k.Sub(curve.N, k)
+	}
+	r := pad32(rx.Bytes())
+
+	e := new(big.Int).SetBytes(taggedHash("BIP0340/challenge", r, pubKey,
+		hash))
+	s := new(big.Int).Mul(e, d)
+	s.Add(s, k)
+	s.Mod(s, curve.N)
+	return append(r, pad32(s.Bytes())...)
+}
+
+func TestTaprootKeyPathSpend(t *testing.T) {
+	d, pubKey := schnorrKey(big.NewInt(0x1234567890))
+	_, otherKey := schnorrKey(big.NewInt(0x0987654321))
+
+	pkScript := append([]byte{btcscript.OP_1, btcscript.OP_DATA_32},
+		pubKey...)
+	otherPkScript := append([]byte{btcscript.OP_1, btcscript.OP_DATA_32},
+		otherKey...)
+
+	tx := witnessTx()
+	tx.AddTxIn(btcwire.NewTxIn(&btcwire.OutPoint{Index: 1}, nil))
+	prevOuts := []*btcwire.TxOut{
+		btcwire.NewTxOut(1000, pkScript),
+		btcwire.NewTxOut(2000, []byte{btcscript.OP_1}),
+	}
+	sign := func(hashType byte, idx int) []byte {
+		hash, err := btcscript.CalcTaprootSignatureHash(hashType, tx,
+			idx, prevOuts)
+		if err != nil {
+			t.Fatalf("CalcTaprootSignatureHash: %v", err)
+		}
+		sig := schnorrSign(d, hash)
+		if hashType != btcscript.SigHashDefault {
+			sig = append(sig, hashType)
+		}
+		return sig
+	}
+	defaultSig := sign(btcscript.SigHashDefault, 0)
+	allSig := sign(btcscript.SigHashAll, 0)
+	anyoneCanPaySig := sign(btcscript.SigHashNone|
+		btcscript.SigHashAnyOneCanPay, 0)
+	flags := btcscript.ScriptBip16 | btcscript.ScriptVerifyWitness |
+		btcscript.ScriptVerifyTaproot
+
+	tests := []struct {
+		name     string
+		pkScript []byte
+		witness  btcscript.TxWitness
+		flags    btcscript.ScriptFlags
+		err      error
+	}{
+		{
+			name:     "default hash type",
+			pkScript: pkScript,
+			witness:  btcscript.TxWitness{defaultSig},
+			flags:    flags,
+		},
+		{
+			name:     "explicit hash type",
+			pkScript: pkScript,
+			witness:  btcscript.TxWitness{allSig},
+			flags:    flags,
+		},
+		{
+			name:     "none anyonecanpay",
+			pkScript: pkScript,
+			witness:  btcscript.TxWitness{anyoneCanPaySig},
+			flags:    flags,
+		},
+		{
+			// All and default sign the same message except for
+			// the hash type.
+			name:     "all signature as default",
+			pkScript: pkScript,
+			witness:  btcscript.TxWitness{allSig[:64]},
+			flags:    flags,
+			err:      btcscript.StackErrSchnorrSig,
+		},
+		{
+			name:     "explicit default hash type",
+			pkScript: pkScript,
+			witness: btcscript.TxWitness{
+				append(defaultSig, btcscript.SigHashDefault)},
+			flags: flags,
+			err:   btcscript.StackErrSchnorrSigHashType,
+		},
+		{
+			name:     "undefined hash type",
+			pkScript: pkScript,
+			witness:  btcscript.TxWitness{append(defaultSig, 0x04)},
+			flags:    flags,
+			err:      btcscript.StackErrSchnorrSigHashType,
+		},
+		{
+			name:     "short signature",
+			pkScript: pkScript,
+			witness:  btcscript.TxWitness{defaultSig[:63]},
+			flags:    flags,
+			err:      btcscript.StackErrSchnorrSigSize,
+		},
+		{
+			name:     "wrong key",
+			pkScript: otherPkScript,
+			witness:  btcscript.TxWitness{defaultSig},
+			flags:    flags,
+			err:      btcscript.StackErrSchnorrSig,
+		},
+		{
+			// The annex is signed, so adding one breaks the
+			// signature.
+			name:     "annex",
+			pkScript: pkScript,
+			witness: btcscript.TxWitness{defaultSig,
+				{0x50, 0x01}},
+			flags: flags,
+			err:   btcscript.StackErrSchnorrSig,
+		},
+		{
+			name:     "empty witness",
+			pkScript: pkScript,
+			flags:    flags,
+			err:      btcscript.StackErrWitnessProgramEmpty,
+		},
+		{
+			name:     "without taproot flag",
+			pkScript: otherPkScript,
+			witness:  btcscript.TxWitness{defaultSig},
+			flags: btcscript.ScriptBip16 |
+				btcscript.ScriptVerifyWitness,
+		},
+	}
+
+	for _, test := range tests {
+		prevOuts[0].PkScript = test.pkScript
+		engine, err := btcscript.NewScriptWithWitness(nil,
+			test.pkScript, test.witness, prevOuts, 0, tx, test.flags)
+		if err != nil {
+			t.Errorf("%s: failed to create script: %v", test.name,
+				err)
+			continue
+		}
+		err = engine.Execute()
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got error [%v], expected [%v]", test.name,
+				err, test.err)
+		}
+	}
+
+	// Shared signature hashes are used whether or not they were made with
+	// the previous outputs.
+	prevOuts[0].PkScript = pkScript
+	for _, sigHashes := range []*btcscript.TxSigHashes{
+		btcscript.NewTxSigHashes(tx, prevOuts),
+		btcscript.NewTxSigHashes(tx, nil),
+	} {
+		engine, err := btcscript.NewScriptWithWitness(nil, pkScript,
+			btcscript.TxWitness{defaultSig}, prevOuts, 0, tx, flags,
+			btcscript.WithSigHashes(sigHashes))
+		if err != nil {
+			t.Fatalf("failed to create script: %v", err)
+		}
+		if err := engine.Execute(); err != nil {
+			t.Errorf("shared signature hashes: %v", err)
+		}
+	}
+}
+
+func TestCalcTaprootSignatureHash(t *testing.T) {
+	tx := witnessTx()
+	tx.AddTxIn(btcwire.NewTxIn(&btcwire.OutPoint{Index: 1}, nil))
+	prevOuts := []*btcwire.TxOut{
+		btcwire.NewTxOut(1000, []byte{btcscript.OP_1}),
+		btcwire.NewTxOut(2000, []byte{btcscript.OP_1}),
+	}
+
+	// The second input has no output at its index to sign.
+	_, err := btcscript.CalcTaprootSignatureHash(btcscript.SigHashSingle,
+		tx, 1, prevOuts)
+	if err != btcscript.StackErrSchnorrSigHashType {
+		t.Errorf("single without output: got %v, want %v", err,
+			btcscript.StackErrSchnorrSigHashType)
+	}
+	_, err = btcscript.CalcTaprootSignatureHash(btcscript.SigHashAll, tx,
+		2, prevOuts)
+	if err != btcscript.StackErrInvalidIndex {
+		t.Errorf("invalid index: got %v, want %v", err,
+			btcscript.StackErrInvalidIndex)
+	}
+	_, err = btcscript.CalcTaprootSignatureHash(btcscript.SigHashAll, tx,
+		0, prevOuts[:1])
+	if err != btcscript.StackErrInvalidPrevOuts {
+		t.Errorf("missing prevouts: got %v, want %v", err,
+			btcscript.StackErrInvalidPrevOuts)
+	}
+	_, err = btcscript.CalcTaprootSignatureHash(btcscript.SigHashAll, tx,
+		0, []*btcwire.TxOut{prevOuts[0], nil})
+	if err != btcscript.StackErrInvalidPrevOuts {
+		t.Errorf("nil prevout: got %v, want %v", err,
+			btcscript.StackErrInvalidPrevOuts)
+	}
+
+	// Every input signs the amounts of all inputs unless it signs with
+	// SigHashAnyOneCanPay.
+	hashes := make(map[byte][]byte)
+	for _, hashType := range []byte{btcscript.SigHashAll,
+		btcscript.SigHashAll | btcscript.SigHashAnyOneCanPay} {
+		hashes[hashType], err = btcscript.CalcTaprootSignatureHash(
+			hashType, tx, 0, prevOuts)
+		if err != nil {
+			t.Fatalf("hash type %x: %v", hashType, err)
+		}
+	}
+	prevOuts[1].Value++
+	for hashType, hash := range hashes {
+		newHash, err := btcscript.CalcTaprootSignatureHash(hashType,
+			tx, 0, prevOuts)
+		if err != nil {
+			t.Fatalf("hash type %x: %v", hashType, err)
+		}
+		changed := !bytes.Equal(hash, newHash)
+		want := hashType&btcscript.SigHashAnyOneCanPay == 0
+		if changed != want {
+			t.Errorf("hash type %x: hash changed %v, want %v",
+				hashType, changed, want)
+		}
+	}
+}
+
+// tapLeafHash returns the tapleaf hash of script with leaf version leafVersion.
+func tapLeafHash(leafVersion byte, script []byte) []byte {
+	// The scripts of the tests are all shorter than 0xfd bytes.
+	return taggedHash("TapLeaf", []byte{leafVersion, byte(len(script))},
+		script)
+}
+
+// tapscriptOutput returns the pkScript of a taproot output with the internal
+// private key d, which must come from schnorrKey, and a script tree of script
+// and, if it is not nil, a sibling node, along with the control block to
+// spend it through script.
+func tapscriptOutput(d *big.Int, leafVersion byte, script, sibling []byte) ([]byte, []byte) {
+	curve := btcec.S256()
+	root := tapLeafHash(leafVersion, script)
+	if sibling != nil {
+		if bytes.Compare(root, sibling) < 0 {
+			root = taggedHash("TapBranch", root, sibling)
+		} else {
+			root = taggedHash("TapBranch", sibling, root)
+		}
+	}
+
+	px, py := curve.ScalarBaseMult(d.Bytes())
+	internalKey := pad32(px.Bytes())
+	tweak := taggedHash("TapTweak", internalKey, root)
+	tx, ty := curve.ScalarBaseMult(tweak)
+	qx, qy := curve.Add(px, py, tx, ty)
+
+	pkScript := append([]byte{btcscript.OP_1, btcscript.OP_DATA_32},
+		pad32(qx.Bytes())...)
+	controlBlock := append([]byte{leafVersion | byte(qy.Bit(0))},
+		internalKey...)
+	return pkScript, append(controlBlock, sibling...)
+}
+
+func TestTapscriptSpend(t *testing.T) {
+	internal, _ := schnorrKey(big.NewInt(0x1111))
+	d1, pubKey1 := schnorrKey(big.NewInt(0x2222))
+	d2, pubKey2 := schnorrKey(big.NewInt(0x3333))
+	sibling := taggedHash("test/sibling")
+
+	tx := witnessTx()
+	prevOuts := []*btcwire.TxOut{btcwire.NewTxOut(1000, nil)}
+	sign := func(d *big.Int, script []byte, codeSepPos uint32) []byte {
+		prevOuts[0].PkScript, _ = tapscriptOutput(internal, 0xc0,
+			script, sibling)
+		hash, err := btcscript.CalcTapscriptSignatureHash(
+			btcscript.SigHashDefault, tx, 0, prevOuts,
+			tapLeafHash(0xc0, script), codeSepPos)
+		if err != nil {
+			t.Fatalf("CalcTapscriptSignatureHash: %v", err)
+		}
+		return schnorrSign(d, hash)
+	}
+
+	checkSigScript := append([]byte{btcscript.OP_DATA_32}, pubKey1...)
+	checkSigScript = append(checkSigScript, btcscript.OP_CHECKSIG)
+	checkSigAddScript := append([]byte{}, checkSigScript...)
+	checkSigAddScript = append(checkSigAddScript, btcscript.OP_DATA_32)
+	checkSigAddScript = append(checkSigAddScript, pubKey2...)
+	checkSigAddScript = append(checkSigAddScript, btcscript.OP_CHECKSIGADD,
+		btcscript.OP_2, btcscript.OP_EQUAL)
+	codeSepScript := append([]byte{btcscript.OP_CODESEPARATOR},
+		checkSigScript...)
+	manyOpsScript := bytes.Repeat([]byte{btcscript.OP_NOP}, 202)
+	manyOpsScript = append(manyOpsScript, btcscript.OP_1)
+	unknownKeyScript := []byte{btcscript.OP_1, btcscript.OP_1,
+		btcscript.OP_CHECKSIG}
+	budgetScript := bytes.Repeat([]byte{btcscript.OP_1, btcscript.OP_1,
+		btcscript.OP_CHECKSIG, btcscript.OP_VERIFY}, 10)
+	budgetScript = append(budgetScript, btcscript.OP_1)
+
+	tests := []struct {
+		name        string
+		script      []byte
+		stack       [][]byte
+		leafVersion byte
+		mutate      func(controlBlock []byte) []byte
+		err         error
+	}{
+		{
+			name:   "checksig",
+			script: checkSigScript,
+			stack:  [][]byte{sign(d1, checkSigScript, 0xffffffff)},
+		},
+		{
+			name:   "checksig wrong key",
+			script: checkSigScript,
+			stack:  [][]byte{sign(d2, checkSigScript, 0xffffffff)},
+			err:    btcscript.StackErrSchnorrSig,
+		},
+		{
+			name:   "checksig empty signature",
+			script: checkSigScript,
+			stack:  [][]byte{nil},
+			err:    btcscript.StackErrScriptFailed,
+		},
+		{
+			name: "checksig empty public key",
+			script: []byte{btcscript.OP_1, btcscript.OP_0,
+				btcscript.OP_CHECKSIG},
+			err: btcscript.StackErrPubKeyType,
+		},
+		{
+			name:   "checksig unknown public key type",
+			script: unknownKeyScript,
+		},
+		{
+			name:   "checksigadd 2 of 2",
+			script: checkSigAddScript,
+			stack: [][]byte{sign(d2, checkSigAddScript, 0xffffffff),
+				sign(d1, checkSigAddScript, 0xffffffff)},
+		},
+		{
+			name:   "checksigadd 1 of 2",
+			script: checkSigAddScript,
+			stack: [][]byte{nil,
+				sign(d1, checkSigAddScript, 0xffffffff)},
+			err: btcscript.StackErrScriptFailed,
+		},
+		{
+			name:   "codeseparator",
+			script: codeSepScript,
+			stack:  [][]byte{sign(d1, codeSepScript, 0)},
+		},
+		{
+			name:   "codeseparator not signed",
+			script: codeSepScript,
+			stack:  [][]byte{sign(d1, codeSepScript, 0xffffffff)},
+			err:    btcscript.StackErrSchnorrSig,
+		},
+		{
+			name: "checkmultisig",
+			script: []byte{btcscript.OP_0, btcscript.OP_0,
+				btcscript.OP_0, btcscript.OP_CHECKMULTISIG},
+			err: btcscript.StackErrTapscriptCheckMultiSig,
+		},
+		{
+			name:   "no operation limit",
+			script: manyOpsScript,
+		},
+		{
+			name:   "signature budget",
+			script: budgetScript,
+			err:    btcscript.StackErrTaprootMaxSigOps,
+		},
+		{
+			name: "minimal if",
+			script: []byte{btcscript.OP_IF, btcscript.OP_1,
+				btcscript.OP_ELSE, btcscript.OP_1,
+				btcscript.OP_ENDIF},
+			stack: [][]byte{{0x02}},
+			err:   btcscript.StackErrMinimalIf,
+		},
+		{
+			name:   "oversized stack item",
+			script: []byte{btcscript.OP_DROP, btcscript.OP_1},
+			stack: [][]byte{
+				make([]byte, btcscript.MaxScriptElementSize+1)},
+			err: btcscript.StackErrElementTooBig,
+		},
+		{
+			name:   "op_success",
+			script: []byte{btcscript.OP_0, btcscript.OP_VERIFY, 0xbb},
+		},
+		{
+			name:   "op_success before parse error",
+			script: []byte{btcscript.OP_RESERVED, btcscript.OP_PUSHDATA1},
+		},
+		{
+			name:        "unknown leaf version",
+			script:      []byte{btcscript.OP_RETURN},
+			leafVersion: 0xc2,
+		},
+		{
+			name:   "short control block",
+			script: unknownKeyScript,
+			mutate: func(c []byte) []byte {
+				return c[:32]
+			},
+			err: btcscript.StackErrTaprootControlBlock,
+		},
+		{
+			name:   "control block with partial node",
+			script: unknownKeyScript,
+			mutate: func(c []byte) []byte {
+				return append(c, 0x00)
+			},
+			err: btcscript.StackErrTaprootControlBlock,
+		},
+		{
+			name:   "control block wrong parity",
+			script: unknownKeyScript,
+			mutate: func(c []byte) []byte {
+				c[0] ^= 1
+				return c
+			},
+			err: btcscript.StackErrWitnessProgramMismatch,
+		},
+		{
+			name:   "control block wrong path",
+			script: unknownKeyScript,
+			mutate: func(c []byte) []byte {
+				c[len(c)-1] ^= 1
+				return c
+			},
+			err: btcscript.StackErrWitnessProgramMismatch,
+		},
+	}
+
+	flags := btcscript.ScriptBip16 | btcscript.ScriptVerifyWitness |
+		btcscript.ScriptVerifyTaproot
+	for _, test := range tests {
+		leafVersion := test.leafVersion
+		if leafVersion == 0 {
+			leafVersion = 0xc0
+		}
+		pkScript, controlBlock := tapscriptOutput(internal,
+			leafVersion, test.script, sibling)
+		if test.mutate != nil {
+			controlBlock = test.mutate(controlBlock)
+		}
+		witness := append(btcscript.TxWitness{}, test.stack...)
+		witness = append(witness, test.script, controlBlock)
+
+		prevOuts[0].PkScript = pkScript
+		engine, err := btcscript.NewScriptWithWitness(nil, pkScript,
+			witness, prevOuts, 0, tx, flags)
+		if err != nil {
+			t.Errorf("%s: failed to create script: %v", test.name,
+				err)
+			continue
+		}
+		err = engine.Execute()
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got error [%v], expected [%v]", test.name,
+				err, test.err)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcscript
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/conformal/btcwire"
+	"io"
+)
+
+// ErrTraceNoInput is returned by Trace.Replay for a trace that was not made by
+// RecordTrace, which has no record of the inputs of the script engine.
+var ErrTraceNoInput = errors.New("trace has no recorded engine input")
+
+// TraceVersion is the version of the JSON trace format written by
+// Trace.WriteJSON.  It changes whenever the format does, so that stored traces
+// are never misread.
+const TraceVersion = 1
+
+// TraceStep is the record of a single opcode run by a script engine.
+type TraceStep struct {
+	// Disasm is the opcode as DisasmPC prints it, prefixed by its
+	// position.
+	Disasm string `json:"disasm"`
+
+	// DataStack and AltStack are the hex encoded contents of the stacks
+	// after the opcode, with the top item last.
+	DataStack []string `json:"dstack"`
+	AltStack  []string `json:"astack"`
+
+	// Error is the error the opcode failed with, if any.
+	Error string `json:"error,omitempty"`
+}
+
+// TracePrevOut is the record of an output spent by a transaction input.
+type TracePrevOut struct {
+	Value    int64  `json:"value"`
+	PkScript string `json:"pkscript"`
+}
+
+// TraceInput is the record of the inputs of a script engine, the arguments of
+// NewScriptWithWitness, from which its execution can be replayed.  Scripts,
+// witness items and the transaction are hex encoded.
+type TraceInput struct {
+	SigScript string          `json:"sigscript"`
+	PkScript  string          `json:"pkscript"`
+	Witness   []string        `json:"witness,omitempty"`
+	PrevOuts  []*TracePrevOut `json:"prevouts,omitempty"`
+	TxIndex   int             `json:"txidx"`
+	Tx        string          `json:"tx"`
+	Flags     ScriptFlags     `json:"flags"`
+}
+
+// Trace is the record of the execution of a script engine, which is written
+// to and loaded from a JSON document.
+type Trace struct {
+	Version int `json:"version"`
+
+	// Input is what the engine was made from, if the trace was made by
+	// RecordTrace.
+	Input *TraceInput `json:"input,omitempty"`
+
+	Steps []TraceStep `json:"steps"`
+
+	// Error is the final error of the execution, empty if it succeeded.
+	Error string `json:"error,omitempty"`
+}
+
+// TraceRecorder is a Tracer that records each opcode run by a script engine
+// into a Trace.
+type TraceRecorder struct {
+	steps  []TraceStep
+	disasm string
+}
+
+// NewTraceRecorder returns a TraceRecorder to be passed to a script engine
+// with WithTracer.
+func NewTraceRecorder() *TraceRecorder {
+	return &TraceRecorder{}
+}
+
+// hexStack returns the items of stack hex encoded.
+func hexStack(stack [][]byte) []string {
+	items := make([]string, len(stack))
+	for i, item := range stack {
+		items[i] = hex.EncodeToString(item)
+	}
+	return items
+}
+
+// BeforeStep records the disassembly of the opcode about to run.
+func (r *TraceRecorder) BeforeStep(state *StepState) {
+	pop := parsedOpcode{opcode: opcodemap[state.Opcode], data: state.Data}
+	r.disasm = disasmOpcode(state.ScriptIndex, state.Offset, &pop)
+}
+
+// AfterStep records the stacks the opcode left and its error.
+func (r *TraceRecorder) AfterStep(state *StepState, err error) {
+	step := TraceStep{
+		Disasm:    r.disasm,
+		DataStack: hexStack(state.DataStack),
+		AltStack:  hexStack(state.AltStack),
+	}
+	if err != nil {
+		step.Error = err.Error()
+	}
+	r.steps = append(r.steps, step)
+}
+
+// Trace returns the trace of the steps recorded so far, with err, as returned
+// by Execute, as its final error.
+func (r *TraceRecorder) Trace(err error) *Trace {
+	trace := &Trace{
+		Version: TraceVersion,
+		Steps:   append([]TraceStep(nil), r.steps...),
+	}
+	if err != nil {
+		trace.Error = err.Error()
+	}
+	return trace
+}
+
+// RecordTrace makes a script engine with NewScriptWithWitness, runs it and
+// returns the trace of its execution along with its inputs, so that it can be
+// replayed.  If the engine can not be made, or tx can not be serialized, the
+// trace has no steps and no inputs and the error is its final error.
+func RecordTrace(scriptSig []byte, scriptPubKey []byte, witness TxWitness, prevOuts []*btcwire.TxOut, txidx int, tx *btcwire.MsgTx, flags ScriptFlags, opts ...ScriptOption) *Trace {
+	recorder := NewTraceRecorder()
+
+	// A nil transaction has no input txidx.
+	if tx == nil {
+		return recorder.Trace(StackErrInvalidIndex)
+	}
+	opts = append(opts[:len(opts):len(opts)], WithTracer(recorder))
+	engine, err := NewScriptWithWitness(scriptSig, scriptPubKey, witness,
+		prevOuts, txidx, tx, flags, opts...)
+	if err != nil {
+		return recorder.Trace(err)
+	}
+
+	var txBuf bytes.Buffer
+	if err := tx.Serialize(&txBuf); err != nil {
+		return recorder.Trace(err)
+	}
+	input := TraceInput{
+		SigScript: hex.EncodeToString(scriptSig),
+		PkScript:  hex.EncodeToString(scriptPubKey),
+		Witness:   hexStack(witness),
+		TxIndex:   txidx,
+		Tx:        hex.EncodeToString(txBuf.Bytes()),
+		Flags:     flags,
+	}
+	for _, prevOut := range prevOuts {
+		// The engine only checks the previous outputs of witness
+		// inputs, so others may be nil and are recorded as null.
+		var tracePrevOut *TracePrevOut
+		if prevOut != nil {
+			tracePrevOut = &TracePrevOut{
+				Value:    prevOut.Value,
+				PkScript: hex.EncodeToString(prevOut.PkScript),
+			}
+		}
+		input.PrevOuts = append(input.PrevOuts, tracePrevOut)
+	}
+
+	trace := recorder.Trace(engine.Execute())
+	trace.Input = &input
+	return trace
+}
+
+// decodeHexStack returns the hex encoded items decoded.
+func decodeHexStack(items []string) ([][]byte, error) {
+	var stack [][]byte
+	for _, item := range items {
+		b, err := hex.DecodeString(item)
+		if err != nil {
+			return nil, err
+		}
+		stack = append(stack, b)
+	}
+	return stack, nil
+}
+
+// Replay runs the script engine the trace was recorded from again, with opts,
+// and returns the trace of the new execution.  Compare the two with
+// DiffTraces to find where the execution has changed.
+func (t *Trace) Replay(opts ...ScriptOption) (*Trace, error) {
+	in := t.Input
+	if in == nil {
+		return nil, ErrTraceNoInput
+	}
+	scripts, err := decodeHexStack([]string{in.SigScript, in.PkScript,
+		in.Tx})
+	if err != nil {
+		return nil, err
+	}
+	witness, err := decodeHexStack(in.Witness)
+	if err != nil {
+		return nil, err
+	}
+	var prevOuts []*btcwire.TxOut
+	for _, prevOut := range in.PrevOuts {
+		if prevOut == nil {
+			prevOuts = append(prevOuts, nil)
+			continue
+		}
+		pkScript, err := hex.DecodeString(prevOut.PkScript)
+		if err != nil {
+			return nil, err
+		}
+		prevOuts = append(prevOuts, btcwire.NewTxOut(prevOut.Value,
+			pkScript))
+	}
+	var tx btcwire.MsgTx
+	if err := tx.Deserialize(bytes.NewReader(scripts[2])); err != nil {
+		return nil, err
+	}
+	return RecordTrace(scripts[0], scripts[1], witness, prevOuts,
+		in.TxIndex, &tx, in.Flags, opts...), nil
+}
+
+// WriteJSON writes the trace to w as an indented JSON document.
+func (t *Trace) WriteJSON(w io.Writer) error {
+	b, err := json.MarshalIndent(t, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// LoadTrace reads a trace written by WriteJSON from r.
+func LoadTrace(r io.Reader) (*Trace, error) {
+	var trace Trace
+	if err := json.NewDecoder(r).Decode(&trace); err != nil {
+		return nil, err
+	}
+	if trace.Version != TraceVersion {
+		return nil, fmt.Errorf("unsupported trace version %d",
+			trace.Version)
+	}
+	return &trace, nil
+}
+
+// TraceDiff is a difference between two traces.
+type TraceDiff struct {
+	// Step is the index of the step that differs, or -1 for the final
+	// error.
+	Step int
+
+	// Field is the field that differs: "disasm", "dstack", "astack" or
+	// "error", or "step" when the step is missing from one of the traces.
+	Field string
+
+	// A and B are the values of the field in each trace.
+	A string
+	B string
+}
+
+// String returns a description of the difference.
+func (d TraceDiff) String() string {
+	if d.Step < 0 {
+		return fmt.Sprintf("final %s: %q != %q", d.Field, d.A, d.B)
+	}
+	return fmt.Sprintf("step %d %s: %q != %q", d.Step, d.Field, d.A, d.B)
+}
+
+// DiffTraces compares the steps and final errors of traces a and b, such as
+// the trace of a failed validation and the trace of replaying it, and returns
+// where they differ.  It returns nil if they are the same.
+func DiffTraces(a, b *Trace) []TraceDiff {
+	var diffs []TraceDiff
+	diff := func(step int, field, x, y string) {
+		if x != y {
+			diffs = append(diffs, TraceDiff{Step: step, Field: field,
+				A: x, B: y})
+		}
+	}
+
+	for i := 0; i < len(a.Steps) || i < len(b.Steps); i++ {
+		switch {
+		case i >= len(b.Steps):
+			diff(i, "step", a.Steps[i].Disasm, "")
+			continue
+		case i >= len(a.Steps):
+			diff(i, "step", "", b.Steps[i].Disasm)
+			continue
+		}
+		x, y := &a.Steps[i], &b.Steps[i]
+		diff(i, "disasm", x.Disasm, y.Disasm)
+		diff(i, "dstack", fmt.Sprint(x.DataStack),
+			fmt.Sprint(y.DataStack))
+		diff(i, "astack", fmt.Sprint(x.AltStack),
+			fmt.Sprint(y.AltStack))
+		diff(i, "error", x.Error, y.Error)
+	}
+	diff(-1, "error", a.Error, b.Error)
+	return diffs
+}
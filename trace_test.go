@@ -0,0 +1,177 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcscript_test
+
+import (
+	"bytes"
+	"github.com/conformal/btcscript"
+	"github.com/conformal/btcwire"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// traceScript runs sigScript against pkScript and returns the trace of it.
+func traceScript(t *testing.T, sigScript, pkScript []byte) *btcscript.Trace {
+	recorder := btcscript.NewTraceRecorder()
+	engine, err := btcscript.NewScript(sigScript, pkScript, 0, witnessTx(),
+		btcscript.ScriptBip16, btcscript.WithTracer(recorder))
+	if err != nil {
+		t.Fatalf("failed to create script: %v", err)
+	}
+	return recorder.Trace(engine.Execute())
+}
+
+func TestTrace(t *testing.T) {
+	pkScript := []byte{btcscript.OP_DATA_1, 0x02, btcscript.OP_TOALTSTACK,
+		btcscript.OP_DROP}
+	trace := traceScript(t, []byte{btcscript.OP_1}, pkScript)
+
+	want := []btcscript.TraceStep{
+		{Disasm: "00:0000: OP_1", DataStack: []string{"01"},
+			AltStack: []string{}},
+		{Disasm: "01:0000: OP_DATA_1 02", DataStack: []string{"01", "02"},
+			AltStack: []string{}},
+		{Disasm: "01:0001: OP_TOALTSTACK", DataStack: []string{"01"},
+			AltStack: []string{"02"}},
+		{Disasm: "01:0002: OP_DROP", DataStack: []string{},
+			AltStack: []string{"02"}},
+	}
+	if !reflect.DeepEqual(trace.Steps, want) {
+		t.Errorf("got steps %v, want %v", trace.Steps, want)
+	}
+	if !strings.Contains(trace.Error, btcscript.StackErrEmptyStack.Error()) {
+		t.Errorf("got error %q, want %q", trace.Error,
+			btcscript.StackErrEmptyStack)
+	}
+
+	var buf bytes.Buffer
+	if err := trace.WriteJSON(&buf); err != nil {
+		t.Fatalf("WriteJSON: %v", err)
+	}
+	loaded, err := btcscript.LoadTrace(&buf)
+	if err != nil {
+		t.Fatalf("LoadTrace: %v", err)
+	}
+	if !reflect.DeepEqual(loaded, trace) {
+		t.Errorf("got loaded trace %v, want %v", loaded, trace)
+	}
+	if diffs := btcscript.DiffTraces(trace, loaded); diffs != nil {
+		t.Errorf("got diffs %v for the same trace", diffs)
+	}
+
+	// The same script succeeding when the item is left on the data stack
+	// differs from the third step on.
+	pkScript[2] = btcscript.OP_NOP
+	other := traceScript(t, []byte{btcscript.OP_1}, pkScript)
+	wantDiffs := []btcscript.TraceDiff{
+		{Step: 2, Field: "disasm", A: "01:0001: OP_TOALTSTACK",
+			B: "01:0001: OP_NOP"},
+		{Step: 2, Field: "dstack", A: "[01]", B: "[01 02]"},
+		{Step: 2, Field: "astack", A: "[02]", B: "[]"},
+		{Step: 3, Field: "dstack", A: "[]", B: "[01]"},
+		{Step: 3, Field: "astack", A: "[02]", B: "[]"},
+		{Step: -1, Field: "error", A: trace.Error, B: ""},
+	}
+	diffs := btcscript.DiffTraces(trace, other)
+	if !reflect.DeepEqual(diffs, wantDiffs) {
+		t.Errorf("got diffs %v, want %v", diffs, wantDiffs)
+	}
+
+	short := *trace
+	short.Steps = short.Steps[:3]
+	diffs = btcscript.DiffTraces(&short, trace)
+	if len(diffs) != 1 || diffs[0].Step != 3 || diffs[0].Field != "step" {
+		t.Errorf("got diffs %v for a missing step", diffs)
+	}
+
+	_, err = btcscript.LoadTrace(strings.NewReader(`{"version": 99}`))
+	if err == nil {
+		t.Errorf("LoadTrace: got no error for an unknown version")
+	}
+}
+
+func TestTraceReplay(t *testing.T) {
+	addScript := []byte{btcscript.OP_ADD, btcscript.OP_3,
+		btcscript.OP_EQUAL}
+	pkScript := p2wshScript(addScript)
+	tx := witnessTx()
+	prevOuts := []*btcwire.TxOut{btcwire.NewTxOut(1000, pkScript)}
+	flags := btcscript.ScriptBip16 | btcscript.ScriptVerifyWitness
+
+	trace := btcscript.RecordTrace(nil, pkScript,
+		btcscript.TxWitness{{0x01}, {0x01}, addScript}, prevOuts, 0, tx,
+		flags)
+	if !strings.Contains(trace.Error,
+		btcscript.StackErrScriptFailed.Error()) {
+		t.Errorf("got error %q, want %q", trace.Error,
+			btcscript.StackErrScriptFailed)
+	}
+
+	var buf bytes.Buffer
+	if err := trace.WriteJSON(&buf); err != nil {
+		t.Fatalf("WriteJSON: %v", err)
+	}
+	loaded, err := btcscript.LoadTrace(&buf)
+	if err != nil {
+		t.Fatalf("LoadTrace: %v", err)
+	}
+	replayed, err := loaded.Replay()
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	if diffs := btcscript.DiffTraces(loaded, replayed); diffs != nil {
+		t.Errorf("got diffs %v replaying the same input", diffs)
+	}
+
+	// Without witness validation the output can be spent by anyone.
+	loaded.Input.Flags = btcscript.ScriptBip16
+	replayed, err = loaded.Replay()
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	if replayed.Error != "" || len(replayed.Steps) != 2 {
+		t.Errorf("replay without witness: got %d steps and error %q, "+
+			"want 2 steps and no error", len(replayed.Steps),
+			replayed.Error)
+	}
+	diffs := btcscript.DiffTraces(loaded, replayed)
+	if len(diffs) == 0 || diffs[len(diffs)-1].Step != -1 {
+		t.Errorf("got diffs %v, want a final error diff", diffs)
+	}
+
+	// A nil previous output of a non-witness input is replayed as such,
+	// and a trace without a transaction has nothing to replay.
+	trace = btcscript.RecordTrace([]byte{btcscript.OP_1},
+		[]byte{btcscript.OP_NOP}, nil, []*btcwire.TxOut{nil}, 0, tx,
+		flags)
+	if trace.Error != "" || trace.Input == nil {
+		t.Fatalf("nil prevout: got error %q, input %v", trace.Error,
+			trace.Input)
+	}
+	replayed, err = trace.Replay()
+	if err != nil {
+		t.Fatalf("nil prevout: Replay: %v", err)
+	}
+	if diffs := btcscript.DiffTraces(trace, replayed); diffs != nil {
+		t.Errorf("nil prevout: got diffs %v", diffs)
+	}
+	trace = btcscript.RecordTrace(nil, pkScript, nil, prevOuts, 0, nil,
+		flags)
+	if trace.Input != nil || trace.Error !=
+		btcscript.StackErrInvalidIndex.Error() {
+		t.Errorf("nil tx: got input %v and error %q, want no input "+
+			"and error %q", trace.Input, trace.Error,
+			btcscript.StackErrInvalidIndex)
+	}
+
+	// A trace made by a TraceRecorder alone can not be replayed.
+	_, err = traceScript(t, []byte{btcscript.OP_1},
+		[]byte{btcscript.OP_NOP}).Replay()
+	if err != btcscript.ErrTraceNoInput {
+		t.Errorf("Replay: got %v, want %v", err,
+			btcscript.ErrTraceNoInput)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcscript
+
+// StepState is the state of a script engine around the execution of a single
+// opcode, as passed to a Tracer.
+type StepState struct {
+	// Opcode is the value of the opcode and OpcodeName its name.
+	Opcode     byte
+	OpcodeName string
+
+	// Data is the data pushed by the opcode, if it is a push.
+	Data []byte
+
+	// ScriptIndex is the index of the script being run: 0 for the
+	// signature script, 1 for the pkScript and 2 and on for redeem and
+	// witness scripts.  Offset is the index of the opcode in the script.
+	ScriptIndex int
+	Offset      int
+
+	// DataStack and AltStack are the contents of the stacks, with the
+	// top item last.  They must not be modified.
+	DataStack [][]byte
+	AltStack  [][]byte
+
+	// CondStack is the conditional execution state, one of OpCondFalse,
+	// OpCondTrue and OpCondSkip for each OP_IF being run, innermost
+	// first.  Opcodes are only executed when it holds nothing but
+	// OpCondTrue.
+	CondStack []int
+
+	// NumOps is the number of operations counted against
+	// MaxOpsPerScript in the script so far.
+	NumOps int
+}
+
+// Tracer is the interface through which a script engine reports each opcode it
+// runs, for debuggers, profilers and audit logs.  It is set with WithTracer.
+type Tracer interface {
+	// BeforeStep is called before the opcode at state is run.
+	BeforeStep(state *StepState)
+
+	// AfterStep is called after the opcode at state has run, with the
+	// stacks it left and the error it failed with, if any, as Step
+	// returns it.  When the opcode ends a script, the stacks are those
+	// the next script starts with.
+	AfterStep(state *StepState, err error)
+}
+
+// WithTracer returns an option that has the script engine report each opcode
+// it runs to tracer.
+func WithTracer(tracer Tracer) ScriptOption {
+	return func(m *Script) {
+		m.tracer = tracer
+	}
+}
+
+// stepState returns the state of the engine for the opcode at offset in the
+// script at scriptIdx, which must be valid.
+func (m *Script) stepState(scriptIdx, offset int) *StepState {
+	pop := m.scripts[scriptIdx][offset]
+	return &StepState{
+		Opcode:      pop.opcode.value,
+		OpcodeName:  pop.opcode.name,
+		Data:        pop.data,
+		ScriptIndex: scriptIdx,
+		Offset:      offset,
+		DataStack:   m.GetStack(),
+		AltStack:    m.GetAltStack(),
+		CondStack:   append([]int(nil), m.condStack...),
+		NumOps:      m.numOps,
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcscript_test
+
+import (
+	"errors"
+	"github.com/conformal/btcscript"
+	"reflect"
+	"testing"
+)
+
+// recordingTracer is a Tracer that keeps every state it is passed.
+type recordingTracer struct {
+	before []*btcscript.StepState
+	after  []*btcscript.StepState
+	errs   []error
+}
+
+func (r *recordingTracer) BeforeStep(state *btcscript.StepState) {
+	r.before = append(r.before, state)
+}
+
+func (r *recordingTracer) AfterStep(state *btcscript.StepState, err error) {
+	r.after = append(r.after, state)
+	r.errs = append(r.errs, err)
+}
+
+func TestTracer(t *testing.T) {
+	sigScript := []byte{btcscript.OP_1}
+	pkScript := []byte{btcscript.OP_IF, btcscript.OP_DATA_1, 0x02,
+		btcscript.OP_TOALTSTACK, btcscript.OP_ELSE, btcscript.OP_0,
+		btcscript.OP_ENDIF, btcscript.OP_DROP}
+
+	tracer := &recordingTracer{}
+	engine, err := btcscript.NewScript(sigScript, pkScript, 0, witnessTx(),
+		btcscript.ScriptBip16, btcscript.WithTracer(tracer))
+	if err != nil {
+		t.Fatalf("failed to create script: %v", err)
+	}
+	err = engine.Execute()
+	if !errors.Is(err, btcscript.StackErrUnderflow) {
+		t.Fatalf("got error [%v], expected [%v]", err,
+			btcscript.StackErrUnderflow)
+	}
+
+	names := []string{"OP_1", "OP_IF", "OP_DATA_1", "OP_TOALTSTACK",
+		"OP_ELSE", "OP_0", "OP_ENDIF", "OP_DROP"}
+	if len(tracer.before) != len(names) ||
+		len(tracer.after) != len(names) {
+		t.Fatalf("got %d and %d steps, want %d", len(tracer.before),
+			len(tracer.after), len(names))
+	}
+	for i, name := range names {
+		before, after := tracer.before[i], tracer.after[i]
+		if before.OpcodeName != name || after.OpcodeName != name {
+			t.Errorf("step %d: got opcodes %s and %s, want %s", i,
+				before.OpcodeName, after.OpcodeName, name)
+		}
+		if before.ScriptIndex != after.ScriptIndex ||
+			before.Offset != after.Offset {
+			t.Errorf("step %d: position moved from %d:%d to %d:%d",
+				i, before.ScriptIndex, before.Offset,
+				after.ScriptIndex, after.Offset)
+		}
+	}
+
+	// The push of the signature script.
+	if tracer.after[0].ScriptIndex != 0 ||
+		!reflect.DeepEqual(tracer.after[0].DataStack, [][]byte{{1}}) {
+		t.Errorf("step 0: got %+v", tracer.after[0])
+	}
+
+	// The push in the first branch.
+	state := tracer.after[2]
+	if state.ScriptIndex != 1 || state.Offset != 1 ||
+		!reflect.DeepEqual(state.Data, []byte{2}) ||
+		!reflect.DeepEqual(state.DataStack, [][]byte{{2}}) ||
+		!reflect.DeepEqual(state.CondStack, []int{btcscript.OpCondTrue,
+			btcscript.OpCondTrue}) {
+		t.Errorf("step 2: got %+v", state)
+	}
+
+	// The alt stack, and the skipped push in the second branch.
+	state = tracer.before[5]
+	if len(state.DataStack) != 0 ||
+		!reflect.DeepEqual(state.AltStack, [][]byte{{2}}) ||
+		!reflect.DeepEqual(state.CondStack, []int{btcscript.OpCondFalse,
+			btcscript.OpCondTrue}) {
+		t.Errorf("step 5: got %+v", state)
+	}
+	if tracer.after[5].NumOps != 3 {
+		t.Errorf("step 5: got %d ops, want 3", tracer.after[5].NumOps)
+	}
+
+	for i, err := range tracer.errs[:len(names)-1] {
+		if err != nil {
+			t.Errorf("step %d: unexpected error %v", i, err)
+		}
+	}
+	if tracer.errs[len(names)-1] != err {
+		t.Errorf("last step: got error [%v], want [%v]",
+			tracer.errs[len(names)-1], err)
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcscript
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/conformal/btcwire"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// WitnessTx is a transaction along with the witness of each of its inputs,
+// which btcwire.MsgTx has no room for.  Witnesses may be nil for a
+// transaction without any.
+type WitnessTx struct {
+	MsgTx     *btcwire.MsgTx
+	Witnesses []TxWitness
+}
+
+// ValidationError is returned by Validator.Validate for the first input found
+// to be invalid.
+type ValidationError struct {
+	// TxIndex is the index of the transaction in the slice passed to
+	// Validate.
+	TxIndex int
+
+	// InputIndex is the index of the input in the transaction, or -1 if
+	// the error concerns the transaction as a whole.
+	InputIndex int
+
+	// Err is the reason the input is invalid.
+	Err error
+}
+
+// Error returns a description of the failure, including which transaction
+// and input it concerns.
+func (e *ValidationError) Error() string {
+	if e.InputIndex < 0 {
+		return fmt.Sprintf("transaction %d: %v", e.TxIndex, e.Err)
+	}
+	return fmt.Sprintf("transaction %d input %d: %v", e.TxIndex,
+		e.InputIndex, e.Err)
+}
+
+// Unwrap returns the underlying error, so that errors.Is can match it.
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// Validator checks the scripts of the inputs of many transactions at once, as
+// when validating a block, by running them on a fixed number of goroutines.
+// Script engines share no mutable state other than a signature cache, which
+// is safe for concurrent use, so the inputs are independent.
+type Validator struct {
+	workers int
+	flags   ScriptFlags
+	opts    []ScriptOption
+}
+
+// NewValidator returns a Validator that runs scripts with flags and opts on
+// at most workers goroutines at a time.  If workers is not positive, one
+// goroutine per CPU is used.
+func NewValidator(workers int, flags ScriptFlags, opts ...ScriptOption) *Validator {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	return &Validator{workers: workers, flags: flags, opts: opts}
+}
+
+// validateJob is a single input to be validated.
+type validateJob struct {
+	txIdx     int
+	inputIdx  int
+	tx        *WitnessTx
+	prevOuts  []*btcwire.TxOut
+	sigHashes *TxSigHashes
+}
+
+// Validate checks the scripts of every input of txs, whose previous outputs
+// are looked up through fetcher before any script is run.  It returns nil if
+// all inputs are valid, and otherwise a *ValidationError for the first failure
+// found, after which no more inputs are checked.  If ctx is done before every
+// input has been checked, its error is returned instead.
+func (v *Validator) Validate(ctx context.Context, txs []*WitnessTx, fetcher PrevOutFetcher) error {
+	var jobs []validateJob
+	for i, tx := range txs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		numInputs := len(tx.MsgTx.TxIn)
+		if tx.Witnesses != nil && len(tx.Witnesses) != numInputs {
+			return &ValidationError{TxIndex: i, InputIndex: -1,
+				Err: ErrWitnessCount}
+		}
+		prevOuts, err := fetchPrevOuts(tx.MsgTx, fetcher)
+		if err != nil {
+			var perr *PrevOutError
+			if !errors.As(err, &perr) {
+				return &ValidationError{TxIndex: i,
+					InputIndex: -1, Err: err}
+			}
+			return &ValidationError{TxIndex: i,
+				InputIndex: perr.Index, Err: perr.Err}
+		}
+		sigHashes := NewTxSigHashes(tx.MsgTx, prevOuts)
+		for j := 0; j < numInputs; j++ {
+			jobs = append(jobs, validateJob{txIdx: i, inputIdx: j,
+				tx: tx, prevOuts: prevOuts,
+				sigHashes: sigHashes})
+		}
+	}
+
+	// Stop the workers on the first failure as well as when the caller
+	// gives up.
+	workCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var failOnce sync.Once
+	var failure error
+	var numDone int64
+
+	jobChan := make(chan validateJob)
+	workers := v.workers
+	if workers > len(jobs) {
+		workers = len(jobs)
+	}
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for job := range jobChan {
+				if workCtx.Err() != nil {
+					continue
+				}
+				var witness TxWitness
+				if job.tx.Witnesses != nil {
+					witness = job.tx.Witnesses[job.inputIdx]
+				}
+				// The sighash state of the transaction comes
+				// last so that it can not be overridden.
+				opts := append(v.opts[:len(v.opts):len(v.opts)],
+					WithSigHashes(job.sigHashes))
+				err := verifyInput(job.tx.MsgTx, job.inputIdx,
+					witness, job.prevOuts, v.flags, opts)
+				atomic.AddInt64(&numDone, 1)
+				if err != nil {
+					failOnce.Do(func() {
+						failure = &ValidationError{
+							TxIndex:    job.txIdx,
+							InputIndex: job.inputIdx,
+							Err:        err,
+						}
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+
+out:
+	for _, job := range jobs {
+		select {
+		case jobChan <- job:
+		case <-workCtx.Done():
+			break out
+		}
+	}
+	close(jobChan)
+	wg.Wait()
+
+	if failure != nil {
+		return failure
+	}
+	if int(numDone) == len(jobs) {
+		return nil
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,164 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcscript_test
+
+import (
+	"context"
+	"errors"
+	"github.com/conformal/btcscript"
+	"github.com/conformal/btcwire"
+	"testing"
+)
+
+// validatorTxs returns numTxs transactions of numInputs inputs each, spending
+// outputs with pkScript, along with the map of those outputs.
+func validatorTxs(numTxs, numInputs int, pkScript []byte) ([]*btcscript.WitnessTx, btcscript.PrevOutMap) {
+	prevOuts := btcscript.PrevOutMap{}
+	txs := make([]*btcscript.WitnessTx, numTxs)
+	for i := range txs {
+		tx := btcwire.NewMsgTx()
+		tx.AddTxOut(btcwire.NewTxOut(500, []byte{btcscript.OP_RETURN}))
+		for j := 0; j < numInputs; j++ {
+			outPoint := btcwire.OutPoint{Index: uint32(i*numInputs + j)}
+			tx.AddTxIn(btcwire.NewTxIn(&outPoint, nil))
+			prevOuts[outPoint] = btcwire.NewTxOut(1000, pkScript)
+		}
+		txs[i] = &btcscript.WitnessTx{MsgTx: tx}
+	}
+	return txs, prevOuts
+}
+
+// cancelFetcher is a PrevOutFetcher that cancels a context on every lookup.
+type cancelFetcher struct {
+	btcscript.PrevOutMap
+	cancel  context.CancelFunc
+	fetches int
+}
+
+func (f *cancelFetcher) FetchPrevOut(outPoint btcwire.OutPoint) (*btcwire.TxOut, error) {
+	f.fetches++
+	f.cancel()
+	return f.PrevOutMap.FetchPrevOut(outPoint)
+}
+
+// cancelTracer is a Tracer that cancels a context after every step.
+type cancelTracer struct {
+	cancel context.CancelFunc
+}
+
+func (c cancelTracer) BeforeStep(*btcscript.StepState) {}
+
+func (c cancelTracer) AfterStep(*btcscript.StepState, error) {
+	c.cancel()
+}
+
+func TestValidator(t *testing.T) {
+	txs, prevOuts := validatorTxs(10, 5, []byte{btcscript.OP_1})
+	for _, workers := range []int{0, 1, 4, 100} {
+		v := btcscript.NewValidator(workers, btcscript.ScriptBip16)
+		err := v.Validate(context.Background(), txs, prevOuts)
+		if err != nil {
+			t.Errorf("%d workers: %v", workers, err)
+		}
+	}
+	v := btcscript.NewValidator(4, btcscript.ScriptBip16)
+
+	// Make a single input invalid.
+	failing := txs[7].MsgTx.TxIn[3].PreviousOutpoint
+	prevOuts[failing] = btcwire.NewTxOut(1000, []byte{btcscript.OP_0})
+	err := v.Validate(context.Background(), txs, prevOuts)
+	verr, ok := err.(*btcscript.ValidationError)
+	if !ok {
+		t.Fatalf("invalid input: got %v, want a ValidationError", err)
+	}
+	if verr.TxIndex != 7 || verr.InputIndex != 3 ||
+		!errors.Is(verr.Err, btcscript.StackErrScriptFailed) {
+		t.Errorf("invalid input: got tx %d input %d error [%v], want "+
+			"tx 7 input 3 error [%v]", verr.TxIndex,
+			verr.InputIndex, verr.Err, btcscript.StackErrScriptFailed)
+	}
+	if !errors.Is(err, btcscript.StackErrScriptFailed) {
+		t.Errorf("invalid input: errors.Is does not match %v",
+			btcscript.StackErrScriptFailed)
+	}
+
+	delete(prevOuts, failing)
+	err = v.Validate(context.Background(), txs, prevOuts)
+	verr, ok = err.(*btcscript.ValidationError)
+	if !ok || verr.TxIndex != 7 || verr.InputIndex != 3 ||
+		verr.Err != btcscript.ErrMissingPrevOut {
+		t.Errorf("missing prevout: got %v", err)
+	}
+	if !errors.Is(err, btcscript.ErrMissingPrevOut) {
+		t.Errorf("missing prevout: errors.Is does not match %v",
+			btcscript.ErrMissingPrevOut)
+	}
+	prevOuts[failing] = btcwire.NewTxOut(1000, []byte{btcscript.OP_1})
+
+	txs[2].Witnesses = []btcscript.TxWitness{nil}
+	err = v.Validate(context.Background(), txs, prevOuts)
+	verr, ok = err.(*btcscript.ValidationError)
+	if !ok || verr.TxIndex != 2 || verr.InputIndex != -1 ||
+		verr.Err != btcscript.ErrWitnessCount {
+		t.Errorf("witness count: got %v", err)
+	}
+	txs[2].Witnesses = nil
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = v.Validate(ctx, txs, prevOuts)
+	if err != context.Canceled {
+		t.Errorf("cancelled: got %v, want %v", err, context.Canceled)
+	}
+
+	// Cancelling while the previous outputs are fetched stops before the
+	// next transaction.
+	ctx, cancel = context.WithCancel(context.Background())
+	fetcher := &cancelFetcher{PrevOutMap: prevOuts, cancel: cancel}
+	err = v.Validate(ctx, txs, fetcher)
+	if err != context.Canceled || fetcher.fetches != 5 {
+		t.Errorf("cancelled fetching: got %v after %d fetches, want %v "+
+			"after 5", err, fetcher.fetches, context.Canceled)
+	}
+
+	// Cancelling once the only input has been checked changes nothing.
+	ctx, cancel = context.WithCancel(context.Background())
+	v = btcscript.NewValidator(1, btcscript.ScriptBip16,
+		btcscript.WithTracer(cancelTracer{cancel}))
+	txs, prevOuts = validatorTxs(1, 1, []byte{btcscript.OP_1})
+	err = v.Validate(ctx, txs, prevOuts)
+	if err != nil {
+		t.Errorf("cancelled when done: got %v, want nil", err)
+	}
+}
+
+// TestValidatorSigHashes tests that every transaction is checked with its own
+// signature hashes, even if NewValidator is passed some.
+func TestValidatorSigHashes(t *testing.T) {
+	tx, pkScript, witness := p2wpkhSpend(t)
+	prevOuts := btcscript.PrevOutMap{
+		tx.TxIn[0].PreviousOutpoint: btcwire.NewTxOut(0,
+			[]byte{btcscript.OP_1}),
+		tx.TxIn[1].PreviousOutpoint: btcwire.NewTxOut(600000000,
+			pkScript),
+	}
+	txs := []*btcscript.WitnessTx{{MsgTx: tx,
+		Witnesses: []btcscript.TxWitness{nil, witness}}}
+
+	// Signature hashes for another transaction.
+	otherTx := tx.Copy()
+	otherTx.TxIn[0].Sequence = 0
+	sigHashes := btcscript.NewTxSigHashes(otherTx, []*btcwire.TxOut{
+		btcwire.NewTxOut(0, []byte{btcscript.OP_1}),
+		btcwire.NewTxOut(600000000, pkScript),
+	})
+	v := btcscript.NewValidator(1,
+		btcscript.ScriptBip16|btcscript.ScriptVerifyWitness,
+		btcscript.WithSigHashes(sigHashes))
+	err := v.Validate(context.Background(), txs, prevOuts)
+	if err != nil {
+		t.Errorf("got %v, want nil", err)
+	}
+}
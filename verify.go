@@ -0,0 +1,137 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcscript
+
+import (
+	"errors"
+	"fmt"
+	"github.com/conformal/btcwire"
+)
+
+var (
+	// ErrMissingPrevOut is the error of the PrevOutError returned by
+	// VerifyTransaction when the output spent by one of the inputs can not
+	// be found.
+	ErrMissingPrevOut = errors.New("previous output not found")
+
+	// ErrWitnessCount is returned by VerifyTransaction when it is given
+	// witnesses that do not match the inputs of the transaction.
+	ErrWitnessCount = errors.New("number of witnesses does not match " +
+		"number of transaction inputs")
+)
+
+// PrevOutFetcher is the interface through which VerifyTransaction looks up the
+// outputs spent by the inputs of a transaction, which hold the pkScripts to
+// run and the amounts witness signatures commit to.
+type PrevOutFetcher interface {
+	// FetchPrevOut returns the output referenced by outPoint, or nil if
+	// there is none.
+	FetchPrevOut(outPoint btcwire.OutPoint) (*btcwire.TxOut, error)
+}
+
+// PrevOutMap is a PrevOutFetcher for a set of outputs known in advance.
+type PrevOutMap map[btcwire.OutPoint]*btcwire.TxOut
+
+// FetchPrevOut returns the output referenced by outPoint from the map.
+func (m PrevOutMap) FetchPrevOut(outPoint btcwire.OutPoint) (*btcwire.TxOut, error) {
+	return m[outPoint], nil
+}
+
+// InputResult is the result of verifying the scripts of one transaction
+// input.
+type InputResult struct {
+	// Index is the index of the input in the transaction.
+	Index int
+
+	// Err is nil if the input is valid, and the reason it is not
+	// otherwise.
+	Err error
+}
+
+// PrevOutError is returned by VerifyTransaction when the output spent by one
+// of the inputs can not be fetched.
+type PrevOutError struct {
+	// Index is the index of the input in the transaction.
+	Index int
+
+	// Err is ErrMissingPrevOut if the output does not exist, or the error
+	// returned by the PrevOutFetcher.
+	Err error
+}
+
+// Error returns a description of the failure, including which input it
+// concerns.
+func (e *PrevOutError) Error() string {
+	return fmt.Sprintf("input %d: %v", e.Index, e.Err)
+}
+
+// Unwrap returns the underlying error, so that errors.Is can match it.
+func (e *PrevOutError) Unwrap() error {
+	return e.Err
+}
+
+// fetchPrevOuts returns the outputs spent by each of the inputs of tx, in
+// order, or a *PrevOutError for the first one that could not be fetched.
+func fetchPrevOuts(tx *btcwire.MsgTx, fetcher PrevOutFetcher) ([]*btcwire.TxOut, error) {
+	prevOuts := make([]*btcwire.TxOut, len(tx.TxIn))
+	for i, txIn := range tx.TxIn {
+		prevOut, err := fetcher.FetchPrevOut(txIn.PreviousOutpoint)
+		if err != nil {
+			return nil, &PrevOutError{Index: i, Err: err}
+		}
+		if prevOut == nil {
+			return nil, &PrevOutError{Index: i,
+				Err: ErrMissingPrevOut}
+		}
+		prevOuts[i] = prevOut
+	}
+	return prevOuts, nil
+}
+
+// verifyInput runs the scripts of input idx of tx, returning nil if they
+// succeed.
+func verifyInput(tx *btcwire.MsgTx, idx int, witness TxWitness, prevOuts []*btcwire.TxOut, flags ScriptFlags, opts []ScriptOption) error {
+	engine, err := NewScriptWithWitness(tx.TxIn[idx].SignatureScript,
+		prevOuts[idx].PkScript, witness, prevOuts, idx, tx, flags,
+		opts...)
+	if err != nil {
+		return err
+	}
+	return engine.Execute()
+}
+
+// VerifyTransaction runs the scripts of every input of tx against the outputs
+// they spend, which are looked up through fetcher, and returns one result per
+// input in order.  witnesses holds the witness of each input, and may be nil
+// for a transaction without any.  An error is returned, rather than results,
+// when the transaction can not be checked at all: a *PrevOutError when the
+// previous outputs can not all be fetched, or ErrWitnessCount when the
+// witnesses do not match the inputs.  opts are passed on to the script engine
+// of each input.
+func VerifyTransaction(tx *btcwire.MsgTx, witnesses []TxWitness, fetcher PrevOutFetcher, flags ScriptFlags, opts ...ScriptOption) ([]InputResult, error) {
+	if witnesses != nil && len(witnesses) != len(tx.TxIn) {
+		return nil, ErrWitnessCount
+	}
+	prevOuts, err := fetchPrevOuts(tx, fetcher)
+	if err != nil {
+		return nil, err
+	}
+
+	opts = append([]ScriptOption{WithSigHashes(NewTxSigHashes(tx, prevOuts))},
+		opts...)
+	results := make([]InputResult, len(tx.TxIn))
+	for i := range tx.TxIn {
+		var witness TxWitness
+		if witnesses != nil {
+			witness = witnesses[i]
+		}
+		results[i] = InputResult{
+			Index: i,
+			Err: verifyInput(tx, i, witness, prevOuts, flags,
+				opts),
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcscript_test
+
+import (
+	"errors"
+	"github.com/conformal/btcscript"
+	"github.com/conformal/btcwire"
+	"testing"
+)
+
+// errFetcher is a PrevOutFetcher that always fails.
+type errFetcher struct{}
+
+var errFetch = errors.New("fetch failed")
+
+func (errFetcher) FetchPrevOut(btcwire.OutPoint) (*btcwire.TxOut, error) {
+	return nil, errFetch
+}
+
+func TestVerifyTransaction(t *testing.T) {
+	addScript := []byte{btcscript.OP_ADD, btcscript.OP_3,
+		btcscript.OP_EQUAL}
+
+	tx := btcwire.NewMsgTx()
+	tx.AddTxOut(btcwire.NewTxOut(500, []byte{btcscript.OP_RETURN}))
+	prevOuts := btcscript.PrevOutMap{}
+	pkScripts := [][]byte{
+		{btcscript.OP_1},
+		{btcscript.OP_0},
+		p2wshScript(addScript),
+		{btcscript.OP_VERIFY},
+	}
+	for i, pkScript := range pkScripts {
+		outPoint := btcwire.OutPoint{Index: uint32(i)}
+		tx.AddTxIn(btcwire.NewTxIn(&outPoint, nil))
+		prevOuts[outPoint] = btcwire.NewTxOut(1000, pkScript)
+	}
+	witnesses := []btcscript.TxWitness{nil, nil,
+		{{0x01}, {0x02}, addScript}, nil}
+	flags := btcscript.ScriptBip16 | btcscript.ScriptVerifyWitness
+
+	results, err := btcscript.VerifyTransaction(tx, witnesses, prevOuts,
+		flags)
+	if err != nil {
+		t.Fatalf("VerifyTransaction: %v", err)
+	}
+	want := []error{
+		nil,
+		btcscript.StackErrScriptFailed,
+		nil,
+		btcscript.StackErrUnderflow,
+	}
+	if len(results) != len(want) {
+		t.Fatalf("got %d results, want %d", len(results), len(want))
+	}
+	for i, result := range results {
+		if result.Index != i {
+			t.Errorf("result %d: got index %d", i, result.Index)
+		}
+		if !errors.Is(result.Err, want[i]) {
+			t.Errorf("input %d: got error [%v], expected [%v]", i,
+				result.Err, want[i])
+		}
+	}
+
+	// The witness of the third input is required.
+	results, err = btcscript.VerifyTransaction(tx, nil, prevOuts, flags)
+	if err != nil {
+		t.Fatalf("VerifyTransaction: %v", err)
+	}
+	if !errors.Is(results[2].Err,
+		btcscript.StackErrWitnessProgramEmpty) {
+		t.Errorf("no witnesses: got error [%v], expected [%v]",
+			results[2].Err, btcscript.StackErrWitnessProgramEmpty)
+	}
+
+	_, err = btcscript.VerifyTransaction(tx, witnesses[:2], prevOuts,
+		flags)
+	if err != btcscript.ErrWitnessCount {
+		t.Errorf("short witnesses: got %v, want %v", err,
+			btcscript.ErrWitnessCount)
+	}
+
+	delete(prevOuts, btcwire.OutPoint{Index: 3})
+	_, err = btcscript.VerifyTransaction(tx, witnesses, prevOuts, flags)
+	perr, ok := err.(*btcscript.PrevOutError)
+	if !ok || perr.Index != 3 || perr.Err != btcscript.ErrMissingPrevOut {
+		t.Errorf("missing prevout: got %v, want input 3 error %v", err,
+			btcscript.ErrMissingPrevOut)
+	}
+
+	_, err = btcscript.VerifyTransaction(tx, witnesses, errFetcher{},
+		flags)
+	if !errors.Is(err, errFetch) {
+		t.Errorf("failing fetcher: got %v, want %v", err, errFetch)
+	}
+}
@@ -0,0 +1,250 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcscript
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/conformal/btcwire"
+	"github.com/conformal/fastsha256"
+	"io"
+)
+
+// TxWitness is the witness of a transaction input, the stack of items that
+// take the place of the signature script when spending a segregated witness
+// (bip141) output.  btcwire.TxIn has no room for it, so it is passed to the
+// script engine separately.
+type TxWitness [][]byte
+
+// isWitnessProgram returns whether script is a witness program: a version
+// opcode, OP_0 to OP_16, followed by a single direct push of 2 to 40 bytes.
+func isWitnessProgram(script []byte) bool {
+	if len(script) < 4 || len(script) > 42 {
+		return false
+	}
+	if script[0] != OP_0 && (script[0] < OP_1 || script[0] > OP_16) {
+		return false
+	}
+	return int(script[1])+2 == len(script)
+}
+
+// extractWitnessProgram returns the version and the program of the witness
+// program script.  It must only be called on scripts for which
+// isWitnessProgram returns true.
+func extractWitnessProgram(script []byte) (int, []byte) {
+	version := 0
+	if script[0] != OP_0 {
+		version = int(script[0] - (OP_1 - 1))
+	}
+	return version, script[2:]
+}
+
+// verifyWitnessProgram sets up the script engine to run the script the
+// witness program commits to, once the pkScript holding the program has run.
+// For a pay-to-witness-pubkey-hash program that is the implied
+// pay-to-pubkey-hash script and the witness is its input.  For a
+// pay-to-witness-script-hash program the last witness item is the script and
+// the rest its input.
+func (m *Script) verifyWitnessProgram() error {
+	var script []byte
+	var stack [][]byte
+	switch {
+	case m.witnessVersion == 0 && len(m.witnessProgram) == 20:
+		if len(m.witness) != 2 {
+			return StackErrWitnessProgramMismatch
+		}
+		var err error
+		script, err = PayToPubKeyHashScript(m.witnessProgram)
+		if err != nil {
+			return err
+		}
+		stack = m.witness
+
+	case m.witnessVersion == 0 && len(m.witnessProgram) == 32:
+		if len(m.witness) == 0 {
+			return StackErrWitnessProgramEmpty
+		}
+		script = m.witness[len(m.witness)-1]
+		if len(script) > MaxScriptSize {
+			return StackErrScriptTooBig
+		}
+		hash := calcHash(script, fastsha256.New())
+		if !bytes.Equal(hash, m.witnessProgram) {
+			return StackErrWitnessProgramMismatch
+		}
+		stack = m.witness[:len(m.witness)-1]
+
+	case m.witnessVersion == 0:
+		return StackErrWitnessProgramWrongLength
+
+	case m.witnessVersion == 1 && len(m.witnessProgram) == 32 &&
+		!m.bip16 && m.hasFlag(ScriptVerifyTaproot):
+		return m.verifyTaproot()
+
+	default:
+		// Later witness versions, and taproot programs nested in a
+		// pay-to-script-hash output, are left for future soft forks
+		// and succeed as if their script had left true on the stack.
+		m.SetStack([][]byte{{1}})
+		return nil
+	}
+
+	for _, item := range stack {
+		if len(item) > MaxScriptElementSize {
+			return StackErrElementTooBig
+		}
+	}
+
+	pops, err := parseScript(script)
+	if err != nil {
+		return err
+	}
+	m.witnessScript = true
+	m.scripts = append(m.scripts, pops)
+	m.SetStack(stack)
+	return nil
+}
+
+// writeVarInt serializes val to w as a bitcoin variable length integer.
+func writeVarInt(w io.Writer, val uint64) {
+	switch {
+	case val < 0xfd:
+		w.Write([]byte{uint8(val)})
+	case val <= 0xffff:
+		w.Write([]byte{0xfd})
+		binary.Write(w, binary.LittleEndian, uint16(val))
+	case val <= 0xffffffff:
+		w.Write([]byte{0xfe})
+		binary.Write(w, binary.LittleEndian, uint32(val))
+	default:
+		w.Write([]byte{0xff})
+		binary.Write(w, binary.LittleEndian, val)
+	}
+}
+
+// writeTxOut serializes txOut to w in the same format as in a transaction.
+func writeTxOut(w io.Writer, txOut *btcwire.TxOut) {
+	binary.Write(w, binary.LittleEndian, txOut.Value)
+	writeVarInt(w, uint64(len(txOut.PkScript)))
+	w.Write(txOut.PkScript)
+}
+
+// calcWitnessSignatureHash implements CalcWitnessSignatureHash for an input
+// index known to be valid, using the hashes of the transaction in sigHashes.
+func calcWitnessSignatureHash(scriptCode []byte, hashType byte, sigHashes *TxSigHashes, idx int, amount int64) []byte {
+	var zeroHash [32]byte
+	tx := sigHashes.tx
+	anyoneCanPay := hashType&SigHashAnyOneCanPay != 0
+	baseType := hashType & 0x1f
+
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, tx.Version)
+
+	// The other inputs are only committed to if the signature is not
+	// for this input alone, and their sequence numbers only if all
+	// outputs are signed as well.
+	if !anyoneCanPay {
+		b.Write(sigHashes.hashPrevOuts)
+	} else {
+		b.Write(zeroHash[:])
+	}
+	if !anyoneCanPay && baseType != SigHashSingle &&
+		baseType != SigHashNone {
+		b.Write(sigHashes.hashSequence)
+	} else {
+		b.Write(zeroHash[:])
+	}
+
+	txIn := tx.TxIn[idx]
+	b.Write(txIn.PreviousOutpoint.Hash[:])
+	binary.Write(&b, binary.LittleEndian, txIn.PreviousOutpoint.Index)
+	writeVarInt(&b, uint64(len(scriptCode)))
+	b.Write(scriptCode)
+	binary.Write(&b, binary.LittleEndian, amount)
+	binary.Write(&b, binary.LittleEndian, txIn.Sequence)
+
+	// SigHashSingle only signs the output at the same index as the input,
+	// if there is one.  Unlike the legacy algorithm a missing output is
+	// not signed as the hash 1, but as zero.
+	switch {
+	case baseType != SigHashSingle && baseType != SigHashNone:
+		b.Write(sigHashes.hashOutputs)
+	case baseType == SigHashSingle && idx < len(tx.TxOut):
+		var o bytes.Buffer
+		writeTxOut(&o, tx.TxOut[idx])
+		b.Write(btcwire.DoubleSha256(o.Bytes()))
+	default:
+		b.Write(zeroHash[:])
+	}
+
+	binary.Write(&b, binary.LittleEndian, tx.LockTime)
+	binary.Write(&b, binary.LittleEndian, uint32(hashType))
+
+	return btcwire.DoubleSha256(b.Bytes())
+}
+
+// CalcWitnessSignatureHash returns the hash that is signed for input idx of tx
+// spending a version 0 witness program, using the algorithm of bip143.
+// scriptCode is the script being run from the last OP_CODESEPARATOR, or the
+// implied pay-to-pubkey-hash script for pay-to-witness-pubkey-hash, and
+// amount is the value of the output being spent.  Unlike the legacy
+// algorithm, signatures are not removed from scriptCode.
+func CalcWitnessSignatureHash(scriptCode []byte, hashType byte, tx *btcwire.MsgTx, idx int, amount int64) ([]byte, error) {
+	if idx < 0 || idx >= len(tx.TxIn) {
+		return nil, StackErrInvalidIndex
+	}
+	return calcWitnessSignatureHash(scriptCode, hashType,
+		NewTxSigHashes(tx, nil), idx, amount), nil
+}
+
+// validPrevOuts returns whether prevOuts has an output for each of the inputs
+// of tx.
+func validPrevOuts(prevOuts []*btcwire.TxOut, tx *btcwire.MsgTx) bool {
+	if len(prevOuts) != len(tx.TxIn) {
+		return false
+	}
+	for _, prevOut := range prevOuts {
+		if prevOut == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// isWitnessVersionActive returns whether the script being run is the witness
+// script of a witness program of the given version.
+func (m *Script) isWitnessVersionActive(version int) bool {
+	return m.witnessScript && m.witnessVersion == version
+}
+
+// txSigHashes returns the signature hash state of the transaction, making it
+// if it was not given with WithSigHashes, or if it was made without the
+// previous outputs that the input being spent has.
+func (m *Script) txSigHashes() *TxSigHashes {
+	if m.sigHashes == nil ||
+		m.sigHashes.prevOuts == nil && m.prevOuts != nil {
+		m.sigHashes = NewTxSigHashes(&m.tx, m.prevOuts)
+	}
+	return m.sigHashes
+}
+
+// calcSignatureHash returns the hash signed by a signature with hashType
+// checked against subScript, the script being run from the last
+// OP_CODESEPARATOR.  sigs are the signatures being checked, which are
+// removed from the script first when not running a witness script.
+func (m *Script) calcSignatureHash(subScript []parsedOpcode, hashType byte, sigs ...[]byte) []byte {
+	sigHashes := m.txSigHashes()
+	if m.isWitnessVersionActive(0) {
+		// unparseScript cannot fail for a script that has parsed.
+		scriptCode, _ := unparseScript(subScript)
+		return calcWitnessSignatureHash(scriptCode, hashType,
+			sigHashes, m.txidx, m.prevOuts[m.txidx].Value)
+	}
+
+	for _, sig := range sigs {
+		subScript = removeOpcodeByData(subScript, sig)
+	}
+	return sigHashes.calcScriptHash(subScript, hashType, m.txidx)
+}
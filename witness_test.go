@@ -0,0 +1,578 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcscript_test
+
+import (
+	"bytes"
+	"code.google.com/p/go.crypto/ripemd160"
+	"crypto/sha256"
+	"errors"
+	"github.com/conformal/btcscript"
+	"github.com/conformal/btcwire"
+	"reflect"
+	"testing"
+)
+
+// witnessTx returns a transaction with a single input and output to run
+// witness tests against.
+func witnessTx() *btcwire.MsgTx {
+	return &btcwire.MsgTx{
+		Version: 1,
+		TxIn: []*btcwire.TxIn{
+			&btcwire.TxIn{
+				PreviousOutpoint: btcwire.OutPoint{
+					Hash:  btcwire.ShaHash{},
+					Index: 0,
+				},
+				Sequence: 4294967295,
+			},
+		},
+		TxOut: []*btcwire.TxOut{
+			&btcwire.TxOut{
+				Value:    1000000000,
+				PkScript: []byte{},
+			},
+		},
+		LockTime: 0,
+	}
+}
+
+// p2wshScript returns the pay-to-witness-script-hash pkScript for script.
+func p2wshScript(script []byte) []byte {
+	hash := sha256.Sum256(script)
+	return append([]byte{btcscript.OP_0, btcscript.OP_DATA_32}, hash[:]...)
+}
+
+// p2shScript returns the pay-to-script-hash pkScript for script.
+func p2shScript(script []byte) []byte {
+	hash := sha256.Sum256(script)
+	h := ripemd160.New()
+	h.Write(hash[:])
+	pkScript := []byte{btcscript.OP_HASH160, btcscript.OP_DATA_20}
+	pkScript = h.Sum(pkScript)
+	return append(pkScript, btcscript.OP_EQUAL)
+}
+
+// pushScript returns a sigScript that is a single direct push of script.
+func pushScript(script []byte) []byte {
+	return append([]byte{byte(len(script))}, script...)
+}
+
+func TestWitness(t *testing.T) {
+	// Adds its two arguments and checks the sum is 3.
+	addScript := []byte{btcscript.OP_ADD, btcscript.OP_3,
+		btcscript.OP_EQUAL}
+	dropScript := []byte{btcscript.OP_DROP, btcscript.OP_1}
+	p2wpkh := append([]byte{btcscript.OP_0, btcscript.OP_DATA_20},
+		bytes.Repeat([]byte{0x01}, 20)...)
+	badLength := append([]byte{btcscript.OP_0, btcscript.OP_DATA_24},
+		bytes.Repeat([]byte{0x01}, 24)...)
+	version16 := append([]byte{btcscript.OP_16, btcscript.OP_DATA_32},
+		bytes.Repeat([]byte{0x01}, 32)...)
+	taproot := append([]byte{btcscript.OP_1, btcscript.OP_DATA_32},
+		bytes.Repeat([]byte{0x01}, 32)...)
+	p2shFlags := btcscript.ScriptBip16 | btcscript.ScriptVerifyWitness
+
+	tests := []struct {
+		name      string
+		sigScript []byte
+		pkScript  []byte
+		witness   btcscript.TxWitness
+		flags     btcscript.ScriptFlags
+		parseErr  error
+		err       error
+	}{
+		{
+			name:     "p2wsh",
+			pkScript: p2wshScript(addScript),
+			witness: btcscript.TxWitness{{0x01}, {0x02},
+				addScript},
+			flags: btcscript.ScriptVerifyWitness,
+		},
+		{
+			name:     "p2wsh false result",
+			pkScript: p2wshScript(addScript),
+			witness: btcscript.TxWitness{{0x01}, {0x01},
+				addScript},
+			flags: btcscript.ScriptVerifyWitness,
+			err:   btcscript.StackErrScriptFailed,
+		},
+		{
+			name:     "p2wsh unclean stack",
+			pkScript: p2wshScript(addScript),
+			witness: btcscript.TxWitness{{0x01}, {0x01}, {0x02},
+				addScript},
+			flags: btcscript.ScriptVerifyWitness,
+			err:   btcscript.StackErrCleanStack,
+		},
+		{
+			name:     "p2wsh script mismatch",
+			pkScript: p2wshScript(addScript),
+			witness: btcscript.TxWitness{{0x01}, {0x02},
+				{btcscript.OP_1}},
+			flags: btcscript.ScriptVerifyWitness,
+			err:   btcscript.StackErrWitnessProgramMismatch,
+		},
+		{
+			name:     "p2wsh empty witness",
+			pkScript: p2wshScript(addScript),
+			flags:    btcscript.ScriptVerifyWitness,
+			err:      btcscript.StackErrWitnessProgramEmpty,
+		},
+		{
+			name:     "p2wsh oversized witness item",
+			pkScript: p2wshScript(dropScript),
+			witness: btcscript.TxWitness{
+				make([]byte, btcscript.MaxScriptElementSize+1),
+				dropScript},
+			flags: btcscript.ScriptVerifyWitness,
+			err:   btcscript.StackErrElementTooBig,
+		},
+		{
+			name:      "p2wsh with signature script",
+			sigScript: []byte{btcscript.OP_1},
+			pkScript:  p2wshScript(addScript),
+			witness: btcscript.TxWitness{{0x01}, {0x02},
+				addScript},
+			flags:    btcscript.ScriptVerifyWitness,
+			parseErr: btcscript.StackErrWitnessMalleated,
+		},
+		{
+			name:     "p2wsh without witness flag",
+			pkScript: p2wshScript(addScript),
+		},
+		{
+			name:     "p2wpkh wrong witness size",
+			pkScript: p2wpkh,
+			witness:  btcscript.TxWitness{{0x01}},
+			flags:    btcscript.ScriptVerifyWitness,
+			err:      btcscript.StackErrWitnessProgramMismatch,
+		},
+		{
+			name:     "p2wpkh wrong pubkey",
+			pkScript: p2wpkh,
+			witness:  btcscript.TxWitness{{0x01}, {0x02}},
+			flags:    btcscript.ScriptVerifyWitness,
+			err:      btcscript.StackErrVerifyFailed,
+		},
+		{
+			name:     "version 0 wrong length",
+			pkScript: badLength,
+			witness:  btcscript.TxWitness{{0x01}},
+			flags:    btcscript.ScriptVerifyWitness,
+			err:      btcscript.StackErrWitnessProgramWrongLength,
+		},
+		{
+			name:     "future version",
+			pkScript: version16,
+			witness:  btcscript.TxWitness{{0x01}},
+			flags:    btcscript.ScriptVerifyWitness,
+		},
+		{
+			name:      "p2sh-p2wsh",
+			sigScript: pushScript(p2wshScript(addScript)),
+			pkScript:  p2shScript(p2wshScript(addScript)),
+			witness: btcscript.TxWitness{{0x01}, {0x02},
+				addScript},
+			flags: p2shFlags,
+		},
+		{
+			name:      "p2sh-p2wsh false result",
+			sigScript: pushScript(p2wshScript(addScript)),
+			pkScript:  p2shScript(p2wshScript(addScript)),
+			witness: btcscript.TxWitness{{0x01}, {0x01},
+				addScript},
+			flags: p2shFlags,
+			err:   btcscript.StackErrScriptFailed,
+		},
+		{
+			name:      "p2sh-p2wsh script mismatch",
+			sigScript: pushScript(p2wshScript(addScript)),
+			pkScript:  p2shScript(p2wshScript(addScript)),
+			witness: btcscript.TxWitness{{0x01}, {0x02},
+				{btcscript.OP_1}},
+			flags: p2shFlags,
+			err:   btcscript.StackErrWitnessProgramMismatch,
+		},
+		{
+			name:      "p2sh-p2wpkh wrong pubkey",
+			sigScript: pushScript(p2wpkh),
+			pkScript:  p2shScript(p2wpkh),
+			witness:   btcscript.TxWitness{{0x01}, {0x02}},
+			flags:     p2shFlags,
+			err:       btcscript.StackErrVerifyFailed,
+		},
+		{
+			name: "p2sh-p2wsh with extra push",
+			sigScript: append([]byte{btcscript.OP_1},
+				pushScript(p2wshScript(addScript))...),
+			pkScript: p2shScript(p2wshScript(addScript)),
+			witness: btcscript.TxWitness{{0x01}, {0x02},
+				addScript},
+			flags:    p2shFlags,
+			parseErr: btcscript.StackErrWitnessMalleatedP2SH,
+		},
+		{
+			name: "p2sh-p2wsh with non-direct push",
+			sigScript: append([]byte{btcscript.OP_PUSHDATA1, 34},
+				p2wshScript(addScript)...),
+			pkScript: p2shScript(p2wshScript(addScript)),
+			witness: btcscript.TxWitness{{0x01}, {0x02},
+				addScript},
+			flags:    p2shFlags,
+			parseErr: btcscript.StackErrWitnessMalleatedP2SH,
+		},
+		{
+			name:      "p2sh-p2wsh without witness",
+			sigScript: pushScript(p2wshScript(addScript)),
+			pkScript:  p2shScript(p2wshScript(addScript)),
+			flags:     p2shFlags,
+			err:       btcscript.StackErrWitnessProgramEmpty,
+		},
+		{
+			// Without bip16 the redeem script is not run, and
+			// the witness is unexpected.
+			name:      "p2sh-p2wsh without bip16",
+			sigScript: pushScript(p2wshScript(addScript)),
+			pkScript:  p2shScript(p2wshScript(addScript)),
+			witness: btcscript.TxWitness{{0x01}, {0x02},
+				addScript},
+			flags:    btcscript.ScriptVerifyWitness,
+			parseErr: btcscript.StackErrWitnessUnexpected,
+		},
+		{
+			// Taproot does not apply to nested programs, which
+			// succeed like future versions.
+			name:      "p2sh taproot",
+			sigScript: pushScript(taproot),
+			pkScript:  p2shScript(taproot),
+			witness:   btcscript.TxWitness{{0x01}},
+			flags:     p2shFlags | btcscript.ScriptVerifyTaproot,
+		},
+		{
+			name:     "witness for non-witness script",
+			pkScript: []byte{btcscript.OP_1},
+			witness:  btcscript.TxWitness{{0x01}},
+			flags:    btcscript.ScriptVerifyWitness,
+			parseErr: btcscript.StackErrWitnessUnexpected,
+		},
+	}
+
+	for _, test := range tests {
+		tx := witnessTx()
+		tx.TxIn[0].SignatureScript = test.sigScript
+		prevOuts := []*btcwire.TxOut{
+			btcwire.NewTxOut(1000000000, test.pkScript)}
+		engine, err := btcscript.NewScriptWithWitness(test.sigScript,
+			test.pkScript, test.witness, prevOuts, 0, tx, test.flags)
+		if err != test.parseErr {
+			t.Errorf("%s: got parse error [%v], expected [%v]",
+				test.name, err, test.parseErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		err = engine.Execute()
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got error [%v], expected [%v]", test.name,
+				err, test.err)
+		}
+	}
+}
+
+// TestWitnessScriptActive tests that only the witness script is run as one,
+// and not the witness program or the redeem script that holds it.
+func TestWitnessScriptActive(t *testing.T) {
+	addScript := []byte{btcscript.OP_1, btcscript.OP_ADD, btcscript.OP_2,
+		btcscript.OP_EQUAL}
+	p2shFlags := btcscript.ScriptBip16 | btcscript.ScriptVerifyWitness
+
+	tests := []struct {
+		name      string
+		sigScript []byte
+		pkScript  []byte
+		flags     btcscript.ScriptFlags
+		active    map[int]bool
+	}{
+		{
+			name:     "p2wsh",
+			pkScript: p2wshScript(addScript),
+			flags:    btcscript.ScriptVerifyWitness,
+			active:   map[int]bool{1: false, 2: true},
+		},
+		{
+			name:      "p2sh-p2wsh",
+			sigScript: pushScript(p2wshScript(addScript)),
+			pkScript:  p2shScript(p2wshScript(addScript)),
+			flags:     p2shFlags,
+			active: map[int]bool{0: false, 1: false, 2: false,
+				3: true},
+		},
+	}
+
+	for _, test := range tests {
+		tx := witnessTx()
+		tx.TxIn[0].SignatureScript = test.sigScript
+		prevOuts := []*btcwire.TxOut{
+			btcwire.NewTxOut(1000000000, test.pkScript)}
+		engine, err := btcscript.NewScriptWithWitness(test.sigScript,
+			test.pkScript, btcscript.TxWitness{{0x01}, addScript},
+			prevOuts, 0, tx, test.flags)
+		if err != nil {
+			t.Errorf("%s: failed to create script: %v", test.name,
+				err)
+			continue
+		}
+
+		// Record, before each opcode, whether the script it is in is
+		// run as the witness script.
+		active := map[int]bool{}
+		for done := false; !done; {
+			active[engine.TstScriptIdx()] =
+				engine.TstIsWitnessVersionActive(0)
+			done, err = engine.Step()
+			if err != nil {
+				t.Errorf("%s: failed to execute: %v", test.name,
+					err)
+				break
+			}
+		}
+		if !reflect.DeepEqual(active, test.active) {
+			t.Errorf("%s: got witness script active %v, want %v",
+				test.name, active, test.active)
+		}
+	}
+}
+
+// TestCalcWitnessSignatureHash checks the bip143 signature hash against the
+// examples in the bip.
+func TestCalcWitnessSignatureHash(t *testing.T) {
+	// Spends a pay-to-witness-script-hash 6-of-6 multisig nested in
+	// pay-to-script-hash, signed with every hash type.
+	multiSigTx := "010000000136641869ca081e70f394c6948e8af409e18b619df2" +
+		"ed74aa106c1ca29787b96e0100000000ffffffff0200e9a4350000000019" +
+		"76a914389ffce9cd9ae88dcc0631e88a821ffdbe9bfe2688acc0832f0500" +
+		"0000001976a9147480a33f950689af511e6e84c138dbbd3c3ee41588ac00" +
+		"000000"
+	multiSigScript := "56210307b8ae49ac90a048e9b53357a2354b3334e9c8bee8" +
+		"13ecb98e99a7e07e8c3ba32103b28f0c28bfab54554ae8c658ac5c3e0ce6" +
+		"e79ad336331f78c428dd43eea8449b21034b8113d703413d57761b8b9781" +
+		"957b8c0ac1dfe69f492580ca4195f50376ba4a21033400f6afecb833092a" +
+		"9a21cfdf1ed1376e58c5d1f47de74683123987e967a8f42103a6d48b1131" +
+		"e94ba04d9737d61acdaa1322008af9602b3b14862c07a1789aac162102d8" +
+		"b661b0b3302ee2f162b09e07a55ad5dfbe673a9f01d9f0c1961768102430" +
+		"6b56ae"
+
+	tests := []struct {
+		name       string
+		tx         string
+		idx        int
+		scriptCode string
+		amount     int64
+		hashType   byte
+		hash       string
+	}{
+		{
+			name: "native p2wpkh",
+			tx: "0100000002fff7f7881a8099afa6940d42d1e7f6362bec38171e" +
+				"a3edf433541db4e4ad969f0000000000eeffffffef51e1b804" +
+				"cc89d182d279655c3aa89e815b1b309fe287d9b2b55d57b90e" +
+				"c68a0100000000ffffffff02202cb206000000001976a91482" +
+				"80b37df378db99f66f85c95a783a76ac7a6d5988ac9093510d" +
+				"000000001976a9143bde42dbee7e4dbe6a21b2d50ce2f0167f" +
+				"aa815988ac11000000",
+			idx: 1,
+			scriptCode: "76a9141d0f172a0ecb48aee1be1f2687d2963ae33f71" +
+				"a188ac",
+			amount:   600000000,
+			hashType: btcscript.SigHashAll,
+			hash: "c37af31116d1b27caf68aae9e3ac82f1477929014d5b9176" +
+				"57d0eb49478cb670",
+		},
+		{
+			name: "p2sh-p2wpkh",
+			tx: "0100000001db6b1b20aa0fd7b23880be2ecbd4a98130974cf474" +
+				"8fb66092ac4d3ceb1a54770100000000feffffff02b8b4eb0b" +
+				"000000001976a914a457b684d7f0d539a46a45bbc043f35b59" +
+				"d0d96388ac0008af2f000000001976a914fd270b1ee6abcaea" +
+				"97fea7ad0402e8bd8ad6d77c88ac92040000",
+			idx: 0,
+			scriptCode: "76a91479091972186c449eb1ded22b78e40d009bdf00" +
+				"8988ac",
+			amount:   1000000000,
+			hashType: btcscript.SigHashAll,
+			hash: "64f3b0f4dd2bb3aa1ce8566d220cc74dda9df97d8490cc81" +
+				"d89d735c92e59fb6",
+		},
+		{
+			name:       "p2sh-p2wsh all",
+			tx:         multiSigTx,
+			scriptCode: multiSigScript,
+			amount:     987654321,
+			hashType:   btcscript.SigHashAll,
+			hash: "185c0be5263dce5b4bb50a047973c1b6272bfbd0103a8944" +
+				"4597dc40b248ee7c",
+		},
+		{
+			name:       "p2sh-p2wsh none",
+			tx:         multiSigTx,
+			scriptCode: multiSigScript,
+			amount:     987654321,
+			hashType:   btcscript.SigHashNone,
+			hash: "e9733bc60ea13c95c6527066bb975a2ff29a925e80aa14c2" +
+				"13f686cbae5d2f36",
+		},
+		{
+			name:       "p2sh-p2wsh single",
+			tx:         multiSigTx,
+			scriptCode: multiSigScript,
+			amount:     987654321,
+			hashType:   btcscript.SigHashSingle,
+			hash: "1e1f1c303dc025bd664acb72e583e933fae4cff9148bf78c" +
+				"157d1e8f78530aea",
+		},
+		{
+			name:       "p2sh-p2wsh all anyonecanpay",
+			tx:         multiSigTx,
+			scriptCode: multiSigScript,
+			amount:     987654321,
+			hashType: btcscript.SigHashAll |
+				btcscript.SigHashAnyOneCanPay,
+			hash: "2a67f03e63a6a422125878b40b82da593be8d4efaafe88ee" +
+				"528af6e5a9955c6e",
+		},
+		{
+			name:       "p2sh-p2wsh none anyonecanpay",
+			tx:         multiSigTx,
+			scriptCode: multiSigScript,
+			amount:     987654321,
+			hashType: btcscript.SigHashNone |
+				btcscript.SigHashAnyOneCanPay,
+			hash: "781ba15f3779d5542ce8ecb5c18716733a5ee42a6f51488e" +
+				"c96154934e2c890a",
+		},
+		{
+			name:       "p2sh-p2wsh single anyonecanpay",
+			tx:         multiSigTx,
+			scriptCode: multiSigScript,
+			amount:     987654321,
+			hashType: btcscript.SigHashSingle |
+				btcscript.SigHashAnyOneCanPay,
+			hash: "511e8e52ed574121fc1b654970395502128263f62662e076" +
+				"dc6baf05c2e6a99b",
+		},
+	}
+
+	for _, test := range tests {
+		var tx btcwire.MsgTx
+		err := tx.Deserialize(bytes.NewReader(decodeHex(test.tx)))
+		if err != nil {
+			t.Errorf("%s: failed to deserialize tx: %v", test.name,
+				err)
+			continue
+		}
+		hash, err := btcscript.CalcWitnessSignatureHash(
+			decodeHex(test.scriptCode), test.hashType, &tx, test.idx,
+			test.amount)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !bytes.Equal(hash, decodeHex(test.hash)) {
+			t.Errorf("%s: got hash %x, want %s", test.name, hash,
+				test.hash)
+		}
+	}
+
+	// Out of range input index.
+	var tx btcwire.MsgTx
+	_, err := btcscript.CalcWitnessSignatureHash(nil, btcscript.SigHashAll,
+		&tx, 0, 0)
+	if err != btcscript.StackErrInvalidIndex {
+		t.Errorf("invalid index: got %v, want %v", err,
+			btcscript.StackErrInvalidIndex)
+	}
+}
+
+// p2wpkhSpend returns the signed pay-to-witness-pubkey-hash example of bip143:
+// a transaction whose second input spends the output with pkScript, worth
+// 600000000, with witness.
+func p2wpkhSpend(t *testing.T) (*btcwire.MsgTx, []byte, btcscript.TxWitness) {
+	var tx btcwire.MsgTx
+	err := tx.Deserialize(bytes.NewReader(decodeHex(
+		"0100000002fff7f7881a8099afa6940d42d1e7f6362bec38171ea3edf4" +
+			"33541db4e4ad969f0000000000eeffffffef51e1b804cc89d182d2" +
+			"79655c3aa89e815b1b309fe287d9b2b55d57b90ec68a0100000000" +
+			"ffffffff02202cb206000000001976a9148280b37df378db99f66f" +
+			"85c95a783a76ac7a6d5988ac9093510d000000001976a9143bde42" +
+			"dbee7e4dbe6a21b2d50ce2f0167faa815988ac11000000")))
+	if err != nil {
+		t.Fatalf("failed to deserialize tx: %v", err)
+	}
+	pkScript := decodeHex("00141d0f172a0ecb48aee1be1f2687d2963ae33f71a1")
+	witness := btcscript.TxWitness{
+		decodeHex("304402203609e17b84f6a7d30c80bfa610b5b4542f32a8a0d5" +
+			"447a12fb1366d7f01cc44a0220573a954c4518331561406f90300e" +
+			"8f3358f51928d43c212a8caed02de67eebee01"),
+		decodeHex("025476c2e83188368da1ff3e292e7acafcdb3566bb0ad253f6" +
+			"2fc70f07aeee6357"),
+	}
+	return &tx, pkScript, witness
+}
+
+// TestWitnessPubKeyHashSpend runs the signed native pay-to-witness-pubkey-hash
+// input of the bip143 example through the script engine.
+func TestWitnessPubKeyHashSpend(t *testing.T) {
+	tx, pkScript, witness := p2wpkhSpend(t)
+	flags := btcscript.ScriptBip16 | btcscript.ScriptVerifyWitness
+
+	tests := []struct {
+		name   string
+		amount int64
+		err    error
+	}{
+		{name: "right amount", amount: 600000000},
+		{name: "wrong amount", amount: 600000001,
+			err: btcscript.StackErrScriptFailed},
+	}
+
+	for _, test := range tests {
+		// The first input is not a witness input and its previous
+		// output is not used.
+		prevOuts := []*btcwire.TxOut{
+			btcwire.NewTxOut(0, nil),
+			btcwire.NewTxOut(test.amount, pkScript),
+		}
+		engine, err := btcscript.NewScriptWithWitness(nil, pkScript,
+			witness, prevOuts, 1, tx, flags)
+		if err != nil {
+			t.Errorf("%s: failed to create script: %v", test.name,
+				err)
+			continue
+		}
+		err = engine.Execute()
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got error [%v], expected [%v]", test.name,
+				err, test.err)
+		}
+	}
+
+	// There must be a previous output for every input, and none of them
+	// may be nil.
+	_, err := btcscript.NewScriptWithWitness(nil, pkScript, witness,
+		[]*btcwire.TxOut{btcwire.NewTxOut(600000000, pkScript)}, 1, tx,
+		flags)
+	if err != btcscript.StackErrInvalidPrevOuts {
+		t.Errorf("missing prevouts: got %v, want %v", err,
+			btcscript.StackErrInvalidPrevOuts)
+	}
+	_, err = btcscript.NewScriptWithWitness(nil, pkScript, witness,
+		[]*btcwire.TxOut{btcwire.NewTxOut(0, nil), nil}, 1, tx, flags)
+	if err != btcscript.StackErrInvalidPrevOuts {
+		t.Errorf("nil prevout: got %v, want %v", err,
+			btcscript.StackErrInvalidPrevOuts)
+	}
+}